@@ -0,0 +1,298 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Flags of the anih chunk.
+const (
+	aniIcon     = 1 // frames are ICO or CUR files rather than raw bitmaps
+	aniSequence = 2 // a seq chunk orders the frames
+)
+
+const aniHeaderSize = 36
+
+// aniHeader is the anih chunk of an animated cursor.
+type aniHeader struct {
+	Size     uint32
+	Frames   uint32
+	Steps    uint32
+	Width    uint32
+	Height   uint32
+	BitCount uint32
+	Planes   uint32
+	Rate     uint32 // default display time of a step, in jiffies
+	Flags    uint32
+}
+
+// An Animation is a Windows animated cursor (.ani file): a set of frames
+// shown in a sequence of timed steps.
+type Animation struct {
+	// Frames holds the images of each frame, one per size, with their
+	// hotspots. Frames stored as .ico files have zero hotspots.
+	Frames [][]Cursor
+	// Steps is the display sequence. Several steps may show the same frame.
+	Steps []AnimationStep
+	// Name and Artist are the INAM and IART strings of the INFO list, if
+	// any.
+	Name, Artist string
+}
+
+// An AnimationStep shows one frame of an Animation for a while.
+type AnimationStep struct {
+	// Frame is an index into Animation.Frames.
+	Frame int
+	// Jiffies is the display time in jiffies, sixtieths of a second.
+	Jiffies int
+}
+
+// Duration returns the display time of s.
+func (s AnimationStep) Duration() time.Duration {
+	return time.Duration(s.Jiffies) * time.Second / 60
+}
+
+// DecodeANI reads a Windows animated cursor, a RIFF "ACON" file, decoding
+// every frame.
+func DecodeANI(r io.Reader) (*Animation, error) {
+	var dec Decoder
+	return dec.DecodeANI(r)
+}
+
+// DecodeANI is like the package-level DecodeANI but applies dec's limits.
+// MaxFileSize bounds the whole file, MaxEntries the number of frames and
+// steps as well as the entries of each frame, and MaxTotalPixels the
+// pixels of all frames together.
+func (dec *Decoder) DecodeANI(r io.Reader) (*Animation, error) {
+	file, err := readAllICO(r, limit(dec.MaxFileSize, DefaultMaxFileSize))
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := riffChunks(file, "ACON")
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		anim   Animation
+		hdr    *aniHeader
+		rates  []uint32
+		seq    []uint32
+		frames []riffChunk
+	)
+	for _, c := range chunks {
+		switch c.id {
+		case "anih":
+			if len(c.data) < aniHeaderSize {
+				return nil, c.errorf("truncated anih chunk")
+			}
+			hdr = new(aniHeader)
+			binary.Read(bytes.NewReader(c.data), binary.LittleEndian, hdr)
+		case "rate":
+			rates = riffDwords(c.data)
+		case "seq ":
+			seq = riffDwords(c.data)
+		case "LIST":
+			if len(c.data) < 4 {
+				return nil, c.errorf("truncated LIST chunk")
+			}
+			sub, err := riffSubchunks(c)
+			if err != nil {
+				return nil, err
+			}
+			switch string(c.data[:4]) {
+			case "fram":
+				for _, f := range sub {
+					if f.id == "icon" {
+						frames = append(frames, f)
+					}
+				}
+			case "INFO":
+				for _, s := range sub {
+					switch s.id {
+					case "INAM":
+						anim.Name = riffString(s.data)
+					case "IART":
+						anim.Artist = riffString(s.data)
+					}
+				}
+			}
+		}
+	}
+
+	if hdr == nil {
+		return nil, formatError(nil, "missing anih chunk")
+	}
+	if hdr.Flags&aniIcon == 0 {
+		return nil, formatError(nil, "raw bitmap ani frames are not supported")
+	}
+	if len(frames) == 0 {
+		return nil, ErrNoImages
+	}
+	maxEntries := limit(int64(dec.MaxEntries), DefaultMaxEntries)
+	if n := int64(len(frames)); n > maxEntries {
+		return nil, limitError("too many frames (%d > %d)", n, maxEntries)
+	}
+
+	// Steps follow seq if present and the frames in order otherwise.
+	nSteps := len(frames)
+	if hdr.Flags&aniSequence != 0 && seq != nil {
+		nSteps = len(seq)
+	}
+	if rates != nil && len(rates) < nSteps {
+		nSteps = len(rates)
+	}
+	if n := int64(nSteps); n > maxEntries {
+		return nil, limitError("too many steps (%d > %d)", n, maxEntries)
+	}
+	anim.Steps = make([]AnimationStep, nSteps)
+	for i := range anim.Steps {
+		s := &anim.Steps[i]
+		s.Frame = i
+		if hdr.Flags&aniSequence != 0 && seq != nil {
+			if int64(seq[i]) >= int64(len(frames)) {
+				return nil, formatError(nil, "ani sequence step %d out of range (frame %d of %d)", i, seq[i], len(frames))
+			}
+			s.Frame = int(seq[i])
+		}
+		s.Jiffies = int(hdr.Rate)
+		if rates != nil {
+			s.Jiffies = int(rates[i])
+		}
+	}
+
+	// Each frame is an ICO or CUR file decoded within what remains of the
+	// total pixel budget.
+	total := limit(dec.MaxTotalPixels, DefaultMaxTotalPixels)
+	remaining := total
+	anim.Frames = make([][]Cursor, len(frames))
+	for i, f := range frames {
+		if remaining <= 0 {
+			return nil, limitError("images too large in total (limit %d pixels)", total)
+		}
+		fdec := *dec
+		fdec.MaxFileSize = -1
+		fdec.MaxTotalPixels = remaining
+		d := decoder{limits: fdec}
+		if err := d.decode(bytes.NewReader(f.data)); err != nil {
+			if errors.Is(err, ErrLimitExceeded) {
+				return nil, err
+			}
+			fe := formatError(err, "invalid frame %d", i)
+			fe.Offset = f.offset
+			return nil, fe
+		}
+		cs := make([]Cursor, len(d.images))
+		for j, im := range d.images {
+			cs[j].Image = im
+			if d.head.Type == typeCursor {
+				cs[j].Hotspot = d.entries[j].hotspot()
+			}
+			b := im.Bounds()
+			remaining -= int64(b.Dx()) * int64(b.Dy())
+		}
+		anim.Frames[i] = cs
+	}
+	return &anim, nil
+}
+
+// EncodeANI writes anim to w as a Windows animated cursor. Each frame is
+// stored as a .cur file using the Encoder's default settings.
+func EncodeANI(w io.Writer, anim *Animation) error {
+	var enc Encoder
+	return enc.EncodeANI(w, anim)
+}
+
+// EncodeANI is like the package-level EncodeANI but encodes the frames
+// with enc's settings. A rate chunk is written only if the steps differ in
+// duration, and a seq chunk only if they do not show each frame once in
+// order.
+func (enc *Encoder) EncodeANI(w io.Writer, anim *Animation) error {
+	if len(anim.Frames) == 0 {
+		return ErrNoImages
+	}
+	if len(anim.Steps) == 0 {
+		return errors.New("ico: animation has no steps")
+	}
+
+	ordered := len(anim.Steps) == len(anim.Frames)
+	uniform := true
+	for i, s := range anim.Steps {
+		if s.Frame < 0 || s.Frame >= len(anim.Frames) {
+			return fmt.Errorf("ico: step %d shows frame %d of %d", i, s.Frame, len(anim.Frames))
+		}
+		if s.Jiffies < 0 || int64(s.Jiffies) > math.MaxUint32 {
+			return fmt.Errorf("ico: step %d has invalid duration of %d jiffies", i, s.Jiffies)
+		}
+		ordered = ordered && s.Frame == i
+		uniform = uniform && s.Jiffies == anim.Steps[0].Jiffies
+	}
+
+	var body bytes.Buffer
+	body.WriteString("ACON")
+
+	if anim.Name != "" || anim.Artist != "" {
+		var info bytes.Buffer
+		info.WriteString("INFO")
+		if anim.Name != "" {
+			writeChunk(&info, "INAM", append([]byte(anim.Name), 0))
+		}
+		if anim.Artist != "" {
+			writeChunk(&info, "IART", append([]byte(anim.Artist), 0))
+		}
+		writeChunk(&body, "LIST", info.Bytes())
+	}
+
+	hdr := aniHeader{
+		Size:   aniHeaderSize,
+		Frames: uint32(len(anim.Frames)),
+		Steps:  uint32(len(anim.Steps)),
+		Rate:   uint32(anim.Steps[0].Jiffies),
+		Flags:  aniIcon,
+	}
+	if !ordered {
+		hdr.Flags |= aniSequence
+	}
+	var hb bytes.Buffer
+	binary.Write(&hb, binary.LittleEndian, hdr)
+	writeChunk(&body, "anih", hb.Bytes())
+
+	if !uniform {
+		rates := make([]uint32, len(anim.Steps))
+		for i, s := range anim.Steps {
+			rates[i] = uint32(s.Jiffies)
+		}
+		writeChunk(&body, "rate", dwordBytes(rates))
+	}
+	if !ordered {
+		seq := make([]uint32, len(anim.Steps))
+		for i, s := range anim.Steps {
+			seq[i] = uint32(s.Frame)
+		}
+		writeChunk(&body, "seq ", dwordBytes(seq))
+	}
+
+	var fram bytes.Buffer
+	fram.WriteString("fram")
+	for i, f := range anim.Frames {
+		var cur bytes.Buffer
+		if err := enc.EncodeAllCursors(&cur, f); err != nil {
+			return fmt.Errorf("ico: frame %d: %w", i, err)
+		}
+		writeChunk(&fram, "icon", cur.Bytes())
+	}
+	writeChunk(&body, "LIST", fram.Bytes())
+
+	if body.Len() > math.MaxUint32-8 {
+		return errors.New("ico: encoded file too large")
+	}
+	var out bytes.Buffer
+	writeChunk(&out, "RIFF", body.Bytes())
+	_, err := w.Write(out.Bytes())
+	return err
+}
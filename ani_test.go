@@ -0,0 +1,288 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestDecodeANI tests decoding frames, steps, hotspots and metadata
+func TestDecodeANI(t *testing.T) {
+	t.Parallel()
+
+	frames := [][]byte{
+		encodeTestCursor(t, Cursor{Image: createMaskedImage(32), Hotspot: image.Pt(3, 4)}),
+		encodeTestCursor(t, Cursor{Image: createMaskedImage(16), Hotspot: image.Pt(5, 6)}),
+	}
+	data := buildANI(frames, 2, 5, []uint32{10, 20, 30}, []uint32{0, 1, 0}, "Busy", "Someone")
+
+	anim, err := DecodeANI(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if anim.Name != "Busy" || anim.Artist != "Someone" {
+		t.Errorf("expected Busy by Someone, got %q by %q", anim.Name, anim.Artist)
+	}
+	if len(anim.Frames) != 2 {
+		t.Fatalf("expected 2 frames, got %d", len(anim.Frames))
+	}
+	for i, want := range []struct {
+		size    int
+		hotspot image.Point
+	}{{32, image.Pt(3, 4)}, {16, image.Pt(5, 6)}} {
+		f := anim.Frames[i]
+		if len(f) != 1 || f[0].Image.Bounds().Dx() != want.size || f[0].Hotspot != want.hotspot {
+			t.Errorf("frame %d: expected %dx%d at %v, got %+v", i, want.size, want.size, want.hotspot, f)
+		}
+	}
+
+	wantSteps := []AnimationStep{{0, 10}, {1, 20}, {0, 30}}
+	if len(anim.Steps) != len(wantSteps) {
+		t.Fatalf("expected %d steps, got %d", len(wantSteps), len(anim.Steps))
+	}
+	for i, s := range anim.Steps {
+		if s != wantSteps[i] {
+			t.Errorf("step %d: expected %+v, got %+v", i, wantSteps[i], s)
+		}
+	}
+	if d := anim.Steps[1].Duration(); d != time.Second/3 {
+		t.Errorf("expected 20 jiffies to last 1/3s, got %v", d)
+	}
+}
+
+// TestDecodeANIDefaults tests steps without rate and seq chunks
+func TestDecodeANIDefaults(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, createMaskedImage(16)); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	data := buildANI([][]byte{buf.Bytes(), buf.Bytes()}, 0, 7, nil, nil, "", "")
+
+	anim, err := DecodeANI(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if len(anim.Steps) != 2 || anim.Steps[0] != (AnimationStep{0, 7}) || anim.Steps[1] != (AnimationStep{1, 7}) {
+		t.Errorf("expected frames in order at 7 jiffies, got %+v", anim.Steps)
+	}
+	if anim.Frames[0][0].Hotspot != (image.Point{}) {
+		t.Errorf("expected zero hotspot for .ico frame, got %v", anim.Frames[0][0].Hotspot)
+	}
+}
+
+// TestDecodeANIErrors tests malformed and oversized animations
+func TestDecodeANIErrors(t *testing.T) {
+	t.Parallel()
+
+	frame := encodeTestCursor(t, Cursor{Image: createMaskedImage(16)})
+	valid := buildANI([][]byte{frame}, 0, 1, nil, nil, "", "")
+
+	badFrame := buildANI([][]byte{frame[:10]}, 0, 1, nil, nil, "", "")
+	noHeader := append([]byte(nil), valid...)
+	copy(noHeader[12:16], "xxxx")
+
+	tests := []struct {
+		name string
+		data []byte
+		dec  Decoder
+		want error
+	}{
+		{"not riff", frame, Decoder{}, ErrFormat},
+		{"truncated", valid[:len(valid)-4], Decoder{}, io.ErrUnexpectedEOF},
+		{"missing anih", noHeader, Decoder{}, ErrFormat},
+		{"bad sequence", buildANI([][]byte{frame}, 2, 1, nil, []uint32{1}, "", ""), Decoder{}, ErrFormat},
+		{"bad frame", badFrame, Decoder{}, ErrFormat},
+		{"too many frames", buildANI([][]byte{frame, frame}, 0, 1, nil, nil, "", ""), Decoder{MaxEntries: 1}, ErrLimitExceeded},
+		{"total pixels", buildANI([][]byte{frame, frame}, 0, 1, nil, nil, "", ""), Decoder{MaxTotalPixels: 300}, ErrLimitExceeded},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := tc.dec.DecodeANI(bytes.NewReader(tc.data))
+			if !errors.Is(err, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func encodeTestCursor(t *testing.T, c Cursor) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := EncodeCursor(&buf, c); err != nil {
+		t.Fatalf("failed to encode cursor: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// buildANI assembles a RIFF ACON file. rates and seq are omitted when nil,
+// as is the INFO list when name and artist are empty.
+func buildANI(frames [][]byte, flags uint32, rate uint32, rates, seq []uint32, name, artist string) []byte {
+	chunk := func(id string, data []byte) []byte {
+		b := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+		b = append(b, data...)
+		if len(data)%2 != 0 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	dwords := func(v []uint32) []byte {
+		var b []byte
+		for _, x := range v {
+			b = binary.LittleEndian.AppendUint32(b, x)
+		}
+		return b
+	}
+
+	nSteps := len(frames)
+	if seq != nil {
+		nSteps = len(seq)
+	}
+	body := []byte("ACON")
+	if name != "" || artist != "" {
+		info := []byte("INFO")
+		info = append(info, chunk("INAM", append([]byte(name), 0))...)
+		info = append(info, chunk("IART", append([]byte(artist), 0))...)
+		body = append(body, chunk("LIST", info)...)
+	}
+	body = append(body, chunk("anih", dwords([]uint32{
+		aniHeaderSize, uint32(len(frames)), uint32(nSteps), 0, 0, 0, 0, rate, flags | aniIcon,
+	}))...)
+	if rates != nil {
+		body = append(body, chunk("rate", dwords(rates))...)
+	}
+	if seq != nil {
+		body = append(body, chunk("seq ", dwords(seq))...)
+	}
+	fram := []byte("fram")
+	for _, f := range frames {
+		fram = append(fram, chunk("icon", f)...)
+	}
+	body = append(body, chunk("LIST", fram)...)
+	return chunk("RIFF", body)
+}
+
+// TestEncodeANI tests that encoded animations decode to the same frames and
+// steps
+func TestEncodeANI(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		steps     []AnimationStep
+		wantRate  bool
+		wantSeq   bool
+		wantFlags uint32
+	}{
+		{"ordered uniform", []AnimationStep{{0, 6}, {1, 6}}, false, false, aniIcon},
+		{"ordered timed", []AnimationStep{{0, 6}, {1, 12}}, true, false, aniIcon},
+		{"sequenced", []AnimationStep{{0, 6}, {1, 6}, {0, 6}, {1, 3}}, true, true, aniIcon | aniSequence},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			anim := &Animation{
+				Frames: [][]Cursor{
+					{{Image: createMaskedImage(32), Hotspot: image.Pt(1, 2)}, {Image: createMaskedImage(16), Hotspot: image.Pt(0, 1)}},
+					{{Image: createMaskedImage(32), Hotspot: image.Pt(3, 4)}},
+				},
+				Steps:  tc.steps,
+				Name:   "Busy",
+				Artist: "Design",
+			}
+			var buf bytes.Buffer
+			if err := EncodeANI(&buf, anim); err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+
+			chunks, err := riffChunks(buf.Bytes(), "ACON")
+			if err != nil {
+				t.Fatalf("failed to parse RIFF: %v", err)
+			}
+			var gotRate, gotSeq bool
+			for _, c := range chunks {
+				switch c.id {
+				case "rate":
+					gotRate = true
+				case "seq ":
+					gotSeq = true
+				case "anih":
+					if flags := binary.LittleEndian.Uint32(c.data[32:]); flags != tc.wantFlags {
+						t.Errorf("expected flags %d, got %d", tc.wantFlags, flags)
+					}
+				}
+			}
+			if gotRate != tc.wantRate || gotSeq != tc.wantSeq {
+				t.Errorf("expected rate=%v seq=%v, got rate=%v seq=%v", tc.wantRate, tc.wantSeq, gotRate, gotSeq)
+			}
+
+			got, err := DecodeANI(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			if got.Name != anim.Name || got.Artist != anim.Artist {
+				t.Errorf("expected %q by %q, got %q by %q", anim.Name, anim.Artist, got.Name, got.Artist)
+			}
+			if len(got.Steps) != len(anim.Steps) {
+				t.Fatalf("expected %d steps, got %d", len(anim.Steps), len(got.Steps))
+			}
+			for i := range anim.Steps {
+				if got.Steps[i] != anim.Steps[i] {
+					t.Errorf("step %d: expected %+v, got %+v", i, anim.Steps[i], got.Steps[i])
+				}
+			}
+			for i, f := range anim.Frames {
+				if len(got.Frames[i]) != len(f) {
+					t.Fatalf("frame %d: expected %d images, got %d", i, len(f), len(got.Frames[i]))
+				}
+				for j, c := range f {
+					g := got.Frames[i][j]
+					if g.Hotspot != c.Hotspot || g.Image.Bounds() != c.Image.Bounds() {
+						t.Errorf("frame %d image %d: expected %v at %v, got %v at %v",
+							i, j, c.Image.Bounds(), c.Hotspot, g.Image.Bounds(), g.Hotspot)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestEncodeANIErrors tests invalid animations
+func TestEncodeANIErrors(t *testing.T) {
+	t.Parallel()
+
+	frames := [][]Cursor{{{Image: createMaskedImage(16)}}}
+	tests := []struct {
+		name string
+		anim *Animation
+	}{
+		{"no frames", &Animation{Steps: []AnimationStep{{0, 1}}}},
+		{"no steps", &Animation{Frames: frames}},
+		{"step out of range", &Animation{Frames: frames, Steps: []AnimationStep{{1, 1}}}},
+		{"negative duration", &Animation{Frames: frames, Steps: []AnimationStep{{0, -1}}}},
+		{"bad hotspot", &Animation{Frames: [][]Cursor{{{Image: createMaskedImage(16), Hotspot: image.Pt(16, 0)}}}, Steps: []AnimationStep{{0, 1}}}},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := EncodeANI(io.Discard, tc.anim); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package ico
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// A Cursor is one image of a Windows .cur file together with its hotspot,
+// the pixel that tracks the pointer position. The hotspot is relative to
+// the top-left corner of the image bounds.
+type Cursor struct {
+	Image   image.Image
+	Hotspot image.Point
+}
+
+// DecodeCursor reads the first image of a .cur file and its hotspot.
+func DecodeCursor(r io.Reader) (Cursor, error) {
+	var dec Decoder
+	return dec.DecodeCursor(r)
+}
+
+// DecodeAllCursors reads every image of a .cur file together with its
+// hotspot. It fails on .ico files, whose directories hold no hotspots.
+func DecodeAllCursors(r io.Reader) ([]Cursor, error) {
+	var dec Decoder
+	return dec.DecodeAllCursors(r)
+}
+
+// DecodeCursor is like the package-level DecodeCursor but applies dec's
+// limits.
+func (dec *Decoder) DecodeCursor(r io.Reader) (Cursor, error) {
+	d := decoder{limits: *dec}
+	file, err := d.decodeDirectory(r)
+	if err != nil {
+		return Cursor{}, err
+	}
+	if d.head.Type != typeCursor {
+		return Cursor{}, ErrNotCursor
+	}
+
+	info, err := d.entryInfoAt(file, 0)
+	if err != nil {
+		return Cursor{}, err
+	}
+	if err := d.checkPixels([]EntryInfo{info}); err != nil {
+		return Cursor{}, err
+	}
+	img, err := d.decodeEntry(file, 0)
+	if err != nil {
+		return Cursor{}, err
+	}
+	return Cursor{Image: img, Hotspot: d.entries[0].hotspot()}, nil
+}
+
+// DecodeAllCursors is like the package-level DecodeAllCursors but applies
+// dec's limits.
+func (dec *Decoder) DecodeAllCursors(r io.Reader) ([]Cursor, error) {
+	d := decoder{limits: *dec}
+	file, err := d.decodeDirectory(r)
+	if err != nil {
+		return nil, err
+	}
+	if d.head.Type != typeCursor {
+		return nil, ErrNotCursor
+	}
+	if err := d.decodeImages(file); err != nil {
+		return nil, err
+	}
+
+	cs := make([]Cursor, len(d.images))
+	for i, im := range d.images {
+		cs[i] = Cursor{Image: im, Hotspot: d.entries[i].hotspot()}
+	}
+	return cs, nil
+}
+
+// hotspot returns the cursor hotspot stored in the Plane and Bits fields.
+func (e *direntry) hotspot() image.Point {
+	return image.Pt(int(e.Plane), int(e.Bits))
+}
+
+// EncodeCursor writes c to w as a single-image .cur file.
+func EncodeCursor(w io.Writer, c Cursor) error {
+	return EncodeAllCursors(w, []Cursor{c})
+}
+
+// EncodeAllCursors writes cs to w as a single .cur file holding one entry
+// per cursor image, using the Encoder's default settings.
+func EncodeAllCursors(w io.Writer, cs []Cursor) error {
+	var enc Encoder
+	return enc.EncodeAllCursors(w, cs)
+}
+
+// EncodeCursor writes c to w as a single-image .cur file.
+func (enc *Encoder) EncodeCursor(w io.Writer, c Cursor) error {
+	return enc.EncodeAllCursors(w, []Cursor{c})
+}
+
+// EncodeAllCursors writes cs to w as a single .cur file holding one entry
+// per cursor image, in the order given.
+func (enc *Encoder) EncodeAllCursors(w io.Writer, cs []Cursor) error {
+	imgs := make([]EntryImage, len(cs))
+	hotspots := make([]image.Point, len(cs))
+	for i, c := range cs {
+		b := c.Image.Bounds()
+		if c.Hotspot.X < 0 || c.Hotspot.Y < 0 || c.Hotspot.X >= b.Dx() || c.Hotspot.Y >= b.Dy() {
+			return fmt.Errorf("ico: hotspot %v outside %dx%d cursor image", c.Hotspot, b.Dx(), b.Dy())
+		}
+		imgs[i].Image = c.Image
+		hotspots[i] = c.Hotspot
+	}
+	return enc.encode(w, typeCursor, imgs, hotspots)
+}
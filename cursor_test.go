@@ -0,0 +1,164 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestEncodeCursor tests writing .cur files with per-image hotspots
+func TestEncodeCursor(t *testing.T) {
+	t.Parallel()
+
+	cursors := []Cursor{
+		{Image: createMaskedImage(32), Hotspot: image.Pt(3, 5)},
+		{Image: createMaskedImage(48), Hotspot: image.Pt(47, 0)},
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeAllCursors(&buf, cursors); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	data := buf.Bytes()
+
+	var h head
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &h); err != nil {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	if h.Zero != 0 || h.Type != 2 || int(h.Number) != len(cursors) {
+		t.Fatalf("unexpected header %+v", h)
+	}
+
+	for i, c := range cursors {
+		e := readTestEntry(t, data, i)
+		if int(e.Plane) != c.Hotspot.X || int(e.Bits) != c.Hotspot.Y {
+			t.Errorf("entry %d: hotspot (%d,%d), want %v", i, e.Plane, e.Bits, c.Hotspot)
+		}
+	}
+
+	decoded, err := DecodeAllCursors(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if len(decoded) != len(cursors) {
+		t.Fatalf("expected %d cursors, got %d", len(cursors), len(decoded))
+	}
+	for i, c := range cursors {
+		if decoded[i].Hotspot != c.Hotspot {
+			t.Errorf("cursor %d: hotspot %v, want %v", i, decoded[i].Hotspot, c.Hotspot)
+		}
+		diff, err := fastCompare(toNRGBAForWrite(c.Image), toNRGBAForWrite(decoded[i].Image))
+		if err != nil {
+			t.Fatalf("cursor %d comparison error: %v", i, err)
+		}
+		if diff != 0 {
+			t.Errorf("cursor %d: pixels differ by %d", i, diff)
+		}
+	}
+}
+
+// TestDecodeCursor tests single-cursor decoding and format registration
+func TestDecodeCursor(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	want := Cursor{Image: createMaskedImage(32), Hotspot: image.Pt(16, 8)}
+	if err := EncodeCursor(&buf, want); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+
+	c, err := DecodeCursor(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if c.Hotspot != want.Hotspot {
+		t.Errorf("hotspot %v, want %v", c.Hotspot, want.Hotspot)
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("image.Decode failed: %v", err)
+	}
+	if format != "cur" {
+		t.Errorf("format %q, want \"cur\"", format)
+	}
+	if !img.Bounds().Eq(want.Image.Bounds()) {
+		t.Errorf("bounds %v, want %v", img.Bounds(), want.Image.Bounds())
+	}
+}
+
+// TestDecodeCursorBrokenEntry tests that DecodeCursor decodes only the first
+// entry, leaving a broken later one to DecodeAllCursors
+func TestDecodeCursorBrokenEntry(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	err := EncodeAllCursors(&buf, []Cursor{
+		{Image: createMaskedImage(32), Hotspot: image.Pt(3, 4)},
+		{Image: createMaskedImage(16), Hotspot: image.Pt(1, 2)},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	data := buf.Bytes()
+	data[readTestEntry(t, data, 1).Offset] = 5
+
+	c, err := DecodeCursor(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if c.Hotspot != image.Pt(3, 4) || c.Image.Bounds().Dx() != 32 {
+		t.Errorf("expected the first cursor, got hotspot %v bounds %v", c.Hotspot, c.Image.Bounds())
+	}
+	var fe *FormatError
+	if _, err := DecodeAllCursors(bytes.NewReader(data)); !errors.As(err, &fe) || fe.Entry != 1 {
+		t.Errorf("expected error for entry 1, got %v", err)
+	}
+}
+
+// TestDecodeCursorNotCursor tests that icons are rejected by the cursor decoder
+func TestDecodeCursorNotCursor(t *testing.T) {
+	t.Parallel()
+
+	reader, err := os.Open("testdata/golang.ico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	_, err = DecodeCursor(reader)
+	if err == nil || !strings.Contains(err.Error(), "not a cursor") {
+		t.Errorf("expected not a cursor error, got %v", err)
+	}
+
+	// Icons are rejected before any entry is decoded.
+	var buf bytes.Buffer
+	if err := Encode(&buf, createMaskedImage(16)); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	data := buf.Bytes()
+	data[readTestEntry(t, data, 0).Offset] = 5
+	if _, err := DecodeAllCursors(bytes.NewReader(data)); err != ErrNotCursor {
+		t.Errorf("expected ErrNotCursor, got %v", err)
+	}
+	if _, err := DecodeCursor(bytes.NewReader(data)); err != ErrNotCursor {
+		t.Errorf("expected ErrNotCursor, got %v", err)
+	}
+}
+
+// TestEncodeCursorHotspotErrors tests rejection of hotspots outside the image
+func TestEncodeCursorHotspotErrors(t *testing.T) {
+	t.Parallel()
+
+	img := createMaskedImage(32)
+	for _, hotspot := range []image.Point{{-1, 0}, {0, -1}, {32, 0}, {0, 32}} {
+		if err := EncodeCursor(io.Discard, Cursor{Image: img, Hotspot: hotspot}); err == nil {
+			t.Errorf("hotspot %v: expected error, got nil", hotspot)
+		}
+	}
+}
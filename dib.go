@@ -0,0 +1,488 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+)
+
+const bitmapInfoHeaderSize = 40
+
+// bitmapInfoHeader is the BITMAPINFOHEADER that starts every DIB entry.
+type bitmapInfoHeader struct {
+	Size          uint32
+	Width         int32
+	Height        int32
+	Planes        uint16
+	BitCount      uint16
+	Compression   uint32
+	SizeImage     uint32
+	XPelsPerMeter int32
+	YPelsPerMeter int32
+	ClrUsed       uint32
+	ClrImportant  uint32
+}
+
+// encodeDIB encodes im as an icon bitmap of the given bit depth: a
+// BITMAPINFOHEADER whose height covers both the XOR bitmap and the AND mask,
+// the colour table for 1, 4 and 8-bit entries, the bottom-up XOR pixels, and
+// a 1-bit AND mask set wherever im is transparent. If rle is set, the 4 or
+// 8-bit XOR pixels are run-length encoded.
+func encodeDIB(im image.Image, bits int, rle bool) ([]byte, error) {
+	b := im.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= 0 || h <= 0 {
+		return nil, fmt.Errorf("ico: invalid image size %dx%d", w, h)
+	}
+
+	var (
+		pal color.Palette
+		idx *paletteIndexer
+	)
+	switch bits {
+	case 1, 4, 8:
+		// Masked pixels must be black in the XOR bitmap so that AND/XOR
+		// renderers show the background unchanged.
+		pal = indexedPalette(im, bits, color.NRGBA{A: 0xff})
+		idx = newPaletteIndexer(pal)
+	case 32:
+	default:
+		return nil, fmt.Errorf("ico: unsupported bit depth %d", bits)
+	}
+
+	xorRowSize := (w*bits + 31) / 32 * 4
+	andRowSize := (w + 31) / 32 * 4
+	xor := make([]byte, xorRowSize*h)
+	and := make([]byte, andRowSize*h)
+
+	// Pixels with any transparency keep their alpha in 32-bit entries, so
+	// only fully transparent ones are masked there.
+	threshold := uint8(alphaThreshold)
+	if bits == 32 {
+		threshold = 1
+	}
+
+	black := uint8(0)
+	if idx != nil {
+		black = idx.index(color.NRGBA{A: 0xff})
+	}
+
+	for y := 0; y < h; y++ {
+		row := h - 1 - y // DIBs are stored bottom-up
+		xorRow := xor[row*xorRowSize : (row+1)*xorRowSize]
+		for x := 0; x < w; x++ {
+			c := color.NRGBAModel.Convert(im.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			masked := c.A < threshold
+			if masked {
+				and[row*andRowSize+x/8] |= 0x80 >> uint(x%8)
+			}
+
+			switch bits {
+			case 32:
+				if !masked {
+					p := xorRow[x*4:]
+					p[0], p[1], p[2], p[3] = c.B, c.G, c.R, c.A
+				}
+			default:
+				i := black
+				if !masked {
+					i = idx.index(c)
+				}
+				perByte := 8 / bits
+				shift := uint(8 - bits - (x%perByte)*bits)
+				xorRow[x/perByte] |= i << shift
+			}
+		}
+	}
+
+	var colorTable []byte
+	if pal != nil {
+		colorTable = make([]byte, 4<<uint(bits))
+	}
+	for i, c := range pal {
+		r, g, b, _ := c.RGBA()
+		colorTable[i*4], colorTable[i*4+1], colorTable[i*4+2] = uint8(b>>8), uint8(g>>8), uint8(r>>8)
+	}
+
+	header := bitmapInfoHeader{
+		Size:      bitmapInfoHeaderSize,
+		Width:     int32(w),
+		Height:    int32(2 * h),
+		Planes:    1,
+		BitCount:  uint16(bits),
+		SizeImage: uint32(len(xor) + len(and)),
+	}
+	if rle {
+		pix := make([]byte, w*h)
+		perByte := 8 / bits
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				shift := uint(8 - bits - (x%perByte)*bits)
+				pix[y*w+x] = xor[y*xorRowSize+x/perByte] >> shift & (1<<uint(bits) - 1)
+			}
+		}
+		header.Compression = biRLE8
+		if bits == 4 {
+			header.Compression = biRLE4
+		}
+		xor = encodeRLE(pix, w, h, bits == 4)
+		// Decoders find the AND mask after the compressed XOR bitmap,
+		// whose size is therefore the image size.
+		header.SizeImage = uint32(len(xor))
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, bitmapInfoHeaderSize+len(colorTable)+len(xor)+len(and)))
+	if err := binary.Write(buf, binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+	buf.Write(colorTable)
+	buf.Write(xor)
+	buf.Write(and)
+	return buf.Bytes(), nil
+}
+
+// Compression values of the DIB header.
+const (
+	biRGB            = 0
+	biRLE8           = 1
+	biRLE4           = 2
+	biBitfields      = 3
+	biAlphaBitfields = 6
+)
+
+// dibHeader holds the fields of any DIB header version that the decoder
+// uses.
+type dibHeader struct {
+	headerSize    int
+	width, height int // height is that of the XOR bitmap alone
+	topDown       bool
+	bits          int
+	compression   uint32
+	sizeImage     int64
+	// masks select the red, green, blue and alpha bits of 16 and 32-bit
+	// pixels. maskSize is the size of the masks stored after a
+	// BITMAPINFOHEADER rather than within the header.
+	masks    [4]uint32
+	maskSize int
+	// colors is the number of colour table entries and colorSize the size
+	// of each: 3 for RGBTRIPLE, 4 for RGBQUAD.
+	colors, colorSize int
+}
+
+// tableOffset returns the offset of the colour table within the payload.
+func (h *dibHeader) tableOffset() int {
+	return h.headerSize + h.maskSize
+}
+
+// pixelOffset returns the offset of the XOR bitmap within the payload.
+func (h *dibHeader) pixelOffset() int {
+	return h.tableOffset() + h.colors*h.colorSize
+}
+
+// parseDIBHeader parses the DIB header at the start of the payload of e.
+// Fields missing from the shorter header versions keep their defaults.
+func parseDIBHeader(payload []byte, e *direntry) (dibHeader, error) {
+	if len(payload) < 4 {
+		return dibHeader{}, truncated("DIB header")
+	}
+	size := binary.LittleEndian.Uint32(payload[:4])
+	if size < 12 || size > 0xFFFF {
+		return dibHeader{}, formatError(nil, "corrupted DIB header size (%d)", size)
+	}
+	h := dibHeader{headerSize: int(size), colorSize: 4}
+
+	var w, ht int64
+	var clrUsed uint32
+	if size == 12 { // BITMAPCOREHEADER
+		if len(payload) < 12 {
+			return dibHeader{}, truncated("DIB header")
+		}
+		w = int64(binary.LittleEndian.Uint16(payload[4:6]))
+		ht = int64(binary.LittleEndian.Uint16(payload[6:8]))
+		h.bits = int(binary.LittleEndian.Uint16(payload[10:12]))
+		h.colorSize = 3
+	} else { // BITMAPINFOHEADER, its OS/2 variants and later versions
+		if len(payload) < 16 || len(payload) < min(int(size), bitmapInfoHeaderSize) {
+			return dibHeader{}, truncated("DIB header")
+		}
+		w = int64(int32(binary.LittleEndian.Uint32(payload[4:8])))
+		ht = int64(int32(binary.LittleEndian.Uint32(payload[8:12])))
+		h.bits = int(binary.LittleEndian.Uint16(payload[14:16]))
+		if size >= 20 {
+			h.compression = binary.LittleEndian.Uint32(payload[16:20])
+		}
+		if size >= 24 {
+			h.sizeImage = int64(binary.LittleEndian.Uint32(payload[20:24]))
+		}
+		if size >= 36 {
+			clrUsed = binary.LittleEndian.Uint32(payload[32:36])
+		}
+		if size == 64 { // OS/2 BITMAPINFOHEADER2
+			h.colorSize = 3
+		}
+	}
+
+	if ht < 0 {
+		h.topDown = true
+		ht = -ht
+	}
+	if w < 0 {
+		return dibHeader{}, formatError(nil, "corrupted bmp dimensions (%dx%d)", w, ht)
+	}
+	h.width = int(w)
+	h.height = int(e.xorHeight(uint32(w), uint32(ht)))
+
+	if h.bits <= 8 {
+		max := uint32(1) << uint(h.bits)
+		if clrUsed == 0 || clrUsed > max {
+			clrUsed = max
+		}
+	} else if clrUsed > 1<<16 {
+		return dibHeader{}, formatError(nil, "corrupted DIB colour count (%d)", clrUsed)
+	}
+	h.colors = int(clrUsed)
+
+	switch h.bits {
+	case 16:
+		h.masks = [4]uint32{0x7c00, 0x03e0, 0x001f, 0}
+	case 32:
+		h.masks = [4]uint32{0xff0000, 0x00ff00, 0x0000ff, 0xff000000}
+	}
+	if h.compression == biBitfields || h.compression == biAlphaBitfields {
+		n := 3
+		if h.compression == biAlphaBitfields {
+			n = 4
+		}
+		var masks []byte
+		switch {
+		case size >= 56: // BITMAPV3INFOHEADER and later hold all four masks
+			n, masks = 4, payload[40:]
+		case size >= 52: // BITMAPV2INFOHEADER
+			masks = payload[40:]
+		case size == bitmapInfoHeaderSize:
+			h.maskSize = 4 * n
+			masks = payload[40:]
+		default:
+			return dibHeader{}, formatError(nil, "corrupted DIB header size (%d) for bit fields", size)
+		}
+		if len(masks) < 4*n {
+			return dibHeader{}, truncated("DIB bit fields")
+		}
+		h.masks = [4]uint32{}
+		for i := 0; i < n; i++ {
+			h.masks[i] = binary.LittleEndian.Uint32(masks[4*i:])
+		}
+	}
+	return h, nil
+}
+
+// A bitfield extracts one channel of a 16 or 32-bit pixel.
+type bitfield struct {
+	shift uint
+	max   uint32
+}
+
+func newBitfield(mask uint32) bitfield {
+	if mask == 0 {
+		return bitfield{}
+	}
+	shift := uint(bits.TrailingZeros32(mask))
+	return bitfield{shift: shift, max: mask >> shift}
+}
+
+// value returns the channel of pixel p scaled to 8 bits.
+func (f bitfield) value(p uint32) uint8 {
+	if f.max == 0 {
+		return 0
+	}
+	return uint8(uint64((p>>f.shift)&f.max) * 0xff / uint64(f.max))
+}
+
+// dibPalette reads the colour table that follows the DIB header of a
+// paletted entry.
+func dibPalette(payload []byte, h *dibHeader) (color.Palette, error) {
+	if len(payload) < h.pixelOffset() {
+		return nil, truncated("DIB colour table")
+	}
+	table := payload[h.tableOffset():]
+	pal := make(color.Palette, h.colors)
+	for i := range pal {
+		p := table[i*h.colorSize:]
+		pal[i] = color.NRGBA{R: p[2], G: p[1], B: p[0], A: 0xff}
+	}
+	return pal, nil
+}
+
+// decodeDIB decodes the DIB payload of e: the XOR bitmap, made transparent
+// wherever the AND mask that follows it is set. 32-bit entries, and 16-bit
+// ones whose bit fields include alpha, carry their own alpha channel; the
+// AND mask applies to them only if every alpha value is zero, as Windows
+// does. A missing AND mask leaves the image opaque.
+func decodeDIB(payload []byte, e *direntry) (image.Image, error) {
+	pl, err := decodeDIBPlanes(payload, e)
+	if err != nil {
+		return nil, err
+	}
+	if pl.hasAlpha || pl.and == nil {
+		return pl.xor, nil
+	}
+	for i, m := range pl.and.Pix {
+		if m != 0 {
+			clear(pl.xor.Pix[i*4 : i*4+4])
+		}
+	}
+	return pl.xor, nil
+}
+
+// dibPlanes holds a DIB entry decoded but not yet composited.
+type dibPlanes struct {
+	// xor is the colour bitmap, opaque unless hasAlpha is set.
+	xor      *image.NRGBA
+	hasAlpha bool
+	// and is the AND mask, 0xff where a bit is set, or nil if the payload
+	// ends without one.
+	and *image.Gray
+}
+
+// decodeDIBPlanes decodes the XOR bitmap and AND mask of the DIB payload
+// of e, top-down.
+func decodeDIBPlanes(payload []byte, e *direntry) (*dibPlanes, error) {
+	h, err := parseDIBHeader(payload, e)
+	if err != nil {
+		return nil, err
+	}
+	switch h.bits {
+	case 1, 2, 4, 8, 16, 24, 32:
+	default:
+		return nil, formatError(nil, "unsupported bmp bit depth %d", h.bits)
+	}
+	switch h.compression {
+	case biRGB:
+	case biRLE8, biRLE4:
+		if h.compression == biRLE8 && h.bits != 8 || h.compression == biRLE4 && h.bits != 4 || h.topDown {
+			return nil, formatError(nil, "RLE compression %d in %d-bit bmp", h.compression, h.bits)
+		}
+		if h.sizeImage == 0 {
+			return nil, formatError(nil, "RLE bmp without image size")
+		}
+	case biBitfields, biAlphaBitfields:
+		if h.bits != 16 && h.bits != 32 {
+			return nil, formatError(nil, "bit fields in %d-bit bmp", h.bits)
+		}
+	default:
+		return nil, formatError(nil, "unsupported bmp compression %d", h.compression)
+	}
+	if h.width == 0 || h.height == 0 {
+		return nil, formatError(nil, "corrupted bmp dimensions (%dx%d)", h.width, h.height)
+	}
+
+	var pal color.Palette
+	if h.bits <= 8 {
+		if pal, err = dibPalette(payload, &h); err != nil {
+			return nil, err
+		}
+	}
+	var fields [4]bitfield
+	for i, m := range h.masks {
+		fields[i] = newBitfield(m)
+	}
+	withAlpha := h.masks[3] != 0
+
+	w, ht := h.width, h.height
+	xor := payload
+	depth := h.bits
+	xorRowSize := (int64(w)*int64(depth) + 31) / 32 * 4
+	xorStart := int64(h.pixelOffset())
+	xorEnd := xorStart + xorRowSize*int64(ht)
+	rle := h.compression == biRLE8 || h.compression == biRLE4
+	if rle {
+		// The compressed size is only known from biSizeImage.
+		xorEnd = xorStart + h.sizeImage
+	}
+	if xorEnd > int64(len(payload)) {
+		return nil, truncated("bmp pixel data")
+	}
+	if rle {
+		// Decompressed, the bitmap has one byte per pixel and no padding.
+		xor = decodeRLE(payload[xorStart:xorEnd], w, ht, h.compression == biRLE4)
+		depth, xorRowSize, xorStart = 8, int64(w), 0
+	}
+	andRowSize := (w + 31) / 32 * 4
+	var and []byte
+	if n := int64(andRowSize) * int64(ht); xorEnd+n <= int64(len(payload)) {
+		and = payload[xorEnd : xorEnd+n]
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, ht))
+	hasAlpha := false
+	for row := 0; row < ht; row++ {
+		y := ht - 1 - row
+		if h.topDown {
+			y = row
+		}
+		src := xor[xorStart+int64(row)*xorRowSize:]
+		dst := img.Pix[y*img.Stride:]
+		for x := 0; x < w; x++ {
+			p := dst[x*4 : x*4+4 : x*4+4]
+			switch depth {
+			case 16, 32:
+				var v uint32
+				if depth == 16 {
+					v = uint32(binary.LittleEndian.Uint16(src[x*2:]))
+				} else {
+					v = binary.LittleEndian.Uint32(src[x*4:])
+				}
+				p[0], p[1], p[2] = fields[0].value(v), fields[1].value(v), fields[2].value(v)
+				if withAlpha {
+					p[3] = fields[3].value(v)
+					hasAlpha = hasAlpha || p[3] != 0
+					continue
+				}
+			case 24:
+				p[0], p[1], p[2] = src[x*3+2], src[x*3+1], src[x*3]
+			default:
+				perByte := 8 / depth
+				shift := uint(8 - depth - (x%perByte)*depth)
+				i := int(src[x/perByte]>>shift) & (1<<uint(depth) - 1)
+				if i < len(pal) {
+					c := pal[i].(color.NRGBA)
+					p[0], p[1], p[2] = c.R, c.G, c.B
+				}
+			}
+			p[3] = 0xff
+		}
+	}
+	pl := &dibPlanes{xor: img, hasAlpha: hasAlpha}
+	if withAlpha && !hasAlpha {
+		setOpaque(img)
+	}
+	if and == nil {
+		return pl, nil
+	}
+
+	pl.and = image.NewGray(image.Rect(0, 0, w, ht))
+	for row := 0; row < ht; row++ {
+		y := ht - 1 - row
+		if h.topDown {
+			y = row
+		}
+		mask := and[row*andRowSize:]
+		dst := pl.and.Pix[y*pl.and.Stride:]
+		for x := 0; x < w; x++ {
+			if mask[x/8]&(0x80>>uint(x%8)) != 0 {
+				dst[x] = 0xff
+			}
+		}
+	}
+	return pl, nil
+}
+
+// setOpaque sets the alpha of every pixel of img to 0xff.
+func setOpaque(img *image.NRGBA) {
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+}
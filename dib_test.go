@@ -0,0 +1,260 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestDecodeDIB tests the native DIB decoder on hand-built payloads covering
+// header versions, bit depths, row order and mask handling
+func TestDecodeDIB(t *testing.T) {
+	t.Parallel()
+
+	red := color.NRGBA{0xff, 0, 0, 0xff}
+	green := color.NRGBA{0, 0xff, 0, 0xff}
+	blue := color.NRGBA{0, 0, 0xff, 0xff}
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	clear := color.NRGBA{}
+
+	// Rows are listed in storage order, so bottom-up unless the height
+	// is negative. The AND mask of each test hides the top-left pixel.
+	andRows := [][]byte{{0x00}, {0x80}}
+
+	tests := []struct {
+		name       string
+		headerSize int
+		bits       int
+		topDown    bool
+		table      []byte
+		masks      []uint32
+		rows       [][]byte
+		and        [][]byte
+		want       [4]color.NRGBA // top-left, top-right, bottom-left, bottom-right
+	}{
+		{
+			name:       "24-bit",
+			headerSize: 40, bits: 24,
+			rows: [][]byte{{0xff, 0, 0, 0xff, 0xff, 0xff}, {0, 0, 0xff, 0, 0xff, 0}},
+			and:  andRows,
+			want: [4]color.NRGBA{clear, green, blue, white},
+		},
+		{
+			name:       "32-bit alpha",
+			headerSize: 40, bits: 32,
+			rows: [][]byte{{0xff, 0, 0, 0xff, 0, 0, 0, 0}, {0, 0, 0xff, 0x80, 0, 0xff, 0, 0xff}},
+			and:  [][]byte{{0x00}, {0x00}},
+			want: [4]color.NRGBA{{0xff, 0, 0, 0x80}, green, blue, clear},
+		},
+		{
+			name:       "32-bit mask when alpha is zero",
+			headerSize: 40, bits: 32,
+			rows: [][]byte{{0xff, 0, 0, 0, 0xff, 0xff, 0xff, 0}, {0, 0, 0xff, 0, 0, 0xff, 0, 0}},
+			and:  andRows,
+			want: [4]color.NRGBA{clear, green, blue, white},
+		},
+		{
+			name:       "32-bit opaque without mask",
+			headerSize: 40, bits: 32,
+			rows: [][]byte{{0xff, 0, 0, 0, 0xff, 0xff, 0xff, 0}, {0, 0, 0xff, 0, 0, 0xff, 0, 0}},
+			want: [4]color.NRGBA{red, green, blue, white},
+		},
+		{
+			name:       "16-bit 5-5-5",
+			headerSize: 40, bits: 16,
+			rows: [][]byte{{0x1f, 0x00, 0xff, 0x7f}, {0x00, 0x7c, 0xe0, 0x03}},
+			and:  andRows,
+			want: [4]color.NRGBA{clear, green, blue, white},
+		},
+		{
+			name:       "16-bit 5-6-5 bit fields",
+			headerSize: 40, bits: 16,
+			masks: []uint32{0xf800, 0x07e0, 0x001f},
+			rows:  [][]byte{{0x1f, 0x00, 0xff, 0xff}, {0x00, 0xf8, 0xe0, 0x07}},
+			and:   andRows,
+			want:  [4]color.NRGBA{clear, green, blue, white},
+		},
+		{
+			name:       "16-bit 4-4-4-4 alpha bit fields",
+			headerSize: 40, bits: 16,
+			masks: []uint32{0x0f00, 0x00f0, 0x000f, 0xf000},
+			rows:  [][]byte{{0x0f, 0xf0, 0x00, 0x00}, {0x00, 0x8f, 0xf0, 0xf0}},
+			and:   [][]byte{{0x00}, {0x00}},
+			want:  [4]color.NRGBA{{0xff, 0, 0, 0x88}, green, blue, clear},
+		},
+		{
+			name:       "32-bit V5 bit fields",
+			headerSize: 124, bits: 32,
+			masks: []uint32{0x000000ff, 0x0000ff00, 0x00ff0000, 0xff000000},
+			rows:  [][]byte{{0, 0, 0xff, 0xff, 0, 0, 0, 0}, {0xff, 0, 0, 0x80, 0, 0xff, 0, 0xff}},
+			and:   [][]byte{{0x00}, {0x00}},
+			want:  [4]color.NRGBA{{0xff, 0, 0, 0x80}, green, blue, clear},
+		},
+		{
+			name:       "32-bit bit fields without alpha",
+			headerSize: 40, bits: 32,
+			masks: []uint32{0x00ff0000, 0x0000ff00, 0x000000ff},
+			rows:  [][]byte{{0xff, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff}, {0, 0, 0xff, 0x00, 0, 0xff, 0, 0x00}},
+			and:   andRows,
+			want:  [4]color.NRGBA{clear, green, blue, white},
+		},
+		{
+			name:       "8-bit top-down",
+			headerSize: 40, bits: 8, topDown: true,
+			table: []byte{0, 0, 0xff, 0, 0, 0xff, 0, 0, 0xff, 0, 0, 0, 0xff, 0xff, 0xff, 0},
+			rows:  [][]byte{{0, 1}, {2, 3}},
+			and:   [][]byte{{0x80}, {0x00}},
+			want:  [4]color.NRGBA{clear, green, blue, white},
+		},
+		{
+			name:       "4-bit V5 header",
+			headerSize: 124, bits: 4,
+			table: []byte{0, 0, 0xff, 0, 0, 0xff, 0, 0, 0xff, 0, 0, 0, 0xff, 0xff, 0xff, 0},
+			rows:  [][]byte{{0x23}, {0x01}},
+			and:   andRows,
+			want:  [4]color.NRGBA{clear, green, blue, white},
+		},
+		{
+			name:       "2-bit",
+			headerSize: 40, bits: 2,
+			table: []byte{0, 0, 0xff, 0, 0, 0xff, 0, 0, 0xff, 0, 0, 0, 0xff, 0xff, 0xff, 0},
+			rows:  [][]byte{{0xb0}, {0x10}},
+			and:   andRows,
+			want:  [4]color.NRGBA{clear, green, blue, white},
+		},
+		{
+			name:       "1-bit core header",
+			headerSize: 12, bits: 1,
+			table: []byte{0, 0, 0xff, 0xff, 0xff, 0xff},
+			rows:  [][]byte{{0x40}, {0x80}},
+			and:   [][]byte{{0x00}, {0x00}},
+			want:  [4]color.NRGBA{white, red, red, white},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			payload := buildDIB(tc.headerSize, 2, 2, tc.bits, tc.topDown, tc.table, tc.masks, tc.rows, tc.and)
+			img, err := Decode(bytes.NewReader(wrapICO(2, 2, payload)))
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			nrgba, ok := img.(*image.NRGBA)
+			if !ok {
+				t.Fatalf("expected *image.NRGBA, got %T", img)
+			}
+			got := [4]color.NRGBA{nrgba.NRGBAAt(0, 0), nrgba.NRGBAAt(1, 0), nrgba.NRGBAAt(0, 1), nrgba.NRGBAAt(1, 1)}
+			if got != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestDecodeDIBErrors tests that malformed DIB payloads are reported as format errors
+func TestDecodeDIBErrors(t *testing.T) {
+	t.Parallel()
+
+	rows := [][]byte{{0, 0, 0, 0, 0, 0}, {0, 0, 0, 0, 0, 0}}
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"truncated pixels", buildDIB(40, 2, 2, 24, false, nil, nil, rows[:1], nil)},
+		{"unsupported depth", buildDIB(40, 2, 2, 7, false, nil, nil, rows, nil)},
+		{"unsupported compression", func() []byte {
+			p := buildDIB(40, 2, 2, 24, false, nil, nil, rows, nil)
+			binary.LittleEndian.PutUint32(p[16:], 9)
+			return p
+		}()},
+		{"bit fields in 24-bit", buildDIB(40, 2, 2, 24, false, nil, []uint32{0xff, 0xff00, 0xff0000}, rows, nil)},
+		{"truncated bit fields", buildDIB(40, 2, 2, 16, false, nil, []uint32{0x1f}, nil, nil)},
+		{"zero width", buildDIB(40, 0, 2, 24, false, nil, nil, rows, nil)},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := Decode(bytes.NewReader(wrapICO(2, 2, tc.payload)))
+			if !errors.Is(err, ErrFormat) {
+				t.Errorf("expected format error, got %v", err)
+			}
+		})
+	}
+}
+
+// buildDIB returns an icon DIB payload with a header of the given size, a
+// colour table, the XOR rows padded to 4 bytes and the optional AND rows.
+// Non-nil masks select BI_BITFIELDS, or BI_ALPHABITFIELDS for four masks
+// after a BITMAPINFOHEADER.
+func buildDIB(headerSize, w, h, bits int, topDown bool, table []byte, masks []uint32, rows, and [][]byte) []byte {
+	header := make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(header[0:], uint32(headerSize))
+	if headerSize == 12 {
+		binary.LittleEndian.PutUint16(header[4:], uint16(w))
+		binary.LittleEndian.PutUint16(header[6:], uint16(2*h))
+		binary.LittleEndian.PutUint16(header[8:], 1)
+		binary.LittleEndian.PutUint16(header[10:], uint16(bits))
+	} else {
+		height := int32(2 * h)
+		if topDown {
+			height = -height
+		}
+		binary.LittleEndian.PutUint32(header[4:], uint32(w))
+		binary.LittleEndian.PutUint32(header[8:], uint32(height))
+		binary.LittleEndian.PutUint16(header[12:], 1)
+		binary.LittleEndian.PutUint16(header[14:], uint16(bits))
+		if table != nil {
+			binary.LittleEndian.PutUint32(header[32:], uint32(len(table)/4))
+		}
+	}
+
+	if masks != nil {
+		compression := uint32(biBitfields)
+		var after []byte
+		for i, m := range masks {
+			if headerSize >= 40+4*(i+1) {
+				binary.LittleEndian.PutUint32(header[40+4*i:], m)
+			} else {
+				after = binary.LittleEndian.AppendUint32(after, m)
+			}
+		}
+		if headerSize == 40 && len(masks) == 4 {
+			compression = biAlphaBitfields
+		}
+		binary.LittleEndian.PutUint32(header[16:], compression)
+		header = append(header, after...)
+	}
+
+	payload := append(header, table...)
+	for _, rows := range [][][]byte{rows, and} {
+		for _, row := range rows {
+			payload = append(payload, row...)
+			payload = append(payload, make([]byte, (4-len(row)%4)%4)...)
+		}
+	}
+	return payload
+}
+
+// wrapICO returns an ICO file holding payload as its only entry.
+func wrapICO(w, h int, payload []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, head{Type: typeIcon, Number: 1})
+	binary.Write(&buf, binary.LittleEndian, direntry{
+		Width:  uint8(w),
+		Height: uint8(h),
+		Plane:  1,
+		Size:   uint32(len(payload)),
+		Offset: headSize + direntrySize,
+	})
+	buf.Write(payload)
+	return buf.Bytes()
+}
@@ -0,0 +1,229 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// EntryInfo describes one entry of an icon or cursor file without decoding
+// its pixels.
+type EntryInfo struct {
+	// Width and Height are the dimensions recorded in the directory. A
+	// stored 0 means 256, except for PNG entries, whose size is then read
+	// from the PNG header.
+	Width, Height int
+	// Colors is the palette size recorded in the directory, 0 if none.
+	Colors int
+	// Planes and Bits are the raw directory fields. In cursor files they
+	// hold the hotspot instead, see Hotspot.
+	Planes, Bits int
+	// Hotspot is the cursor hotspot, or the zero point for icons.
+	Hotspot image.Point
+	// Offset and Size locate the payload within the file.
+	Offset, Size int64
+
+	// Format is the payload kind of icon and cursor entries: FormatPNG or
+	// FormatBMP. It is not set for ICNS entries, see Storage.
+	Format Format
+	// Type is the OSType of ICNS entries, such as "ic08", and empty for
+	// icons and cursors.
+	Type string
+	// Storage is how an ICNS entry stores its image, and empty for icons
+	// and cursors.
+	Storage Storage
+	// ImageWidth, ImageHeight and ImageBits are read from the PNG IHDR chunk
+	// or the DIB header of the payload. For DIB entries ImageHeight is the
+	// height of the image, not the doubled XOR+AND height of the header.
+	ImageWidth, ImageHeight int
+	ImageBits               int
+}
+
+// ReadDirectory returns a description of every entry of the icon or cursor
+// in r, reading only the directory and the header of each payload.
+func ReadDirectory(r io.Reader) ([]EntryInfo, error) {
+	var dec Decoder
+	return dec.ReadDirectory(r)
+}
+
+// ReadDirectory is like the package-level ReadDirectory but applies dec's
+// file size and entry count limits.
+func (dec *Decoder) ReadDirectory(r io.Reader) ([]EntryInfo, error) {
+	d := decoder{limits: *dec}
+	file, err := d.decodeDirectory(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.entryInfos(file)
+}
+
+// entryInfos describes every entry of the parsed directory.
+func (d *decoder) entryInfos(file []byte) ([]EntryInfo, error) {
+	infos := make([]EntryInfo, len(d.entries))
+	for i := range d.entries {
+		info, err := d.entryInfoAt(file, i)
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = info
+	}
+	return infos, nil
+}
+
+// entryInfoAt describes entry i, locating its payload within file.
+func (d *decoder) entryInfoAt(file []byte, i int) (EntryInfo, error) {
+	e := &(d.entries[i])
+	entryData, err := d.entryBytes(file, e)
+	if err != nil {
+		return EntryInfo{}, d.entryError(i, err)
+	}
+	info, err := d.entryInfo(e, entryData)
+	if err != nil {
+		return EntryInfo{}, d.entryError(i, err)
+	}
+	return info, nil
+}
+
+// entryConfigAt is like entryInfoAt but returns an image.Config.
+func (d *decoder) entryConfigAt(file []byte, i int) (image.Config, error) {
+	e := &(d.entries[i])
+	entryData, err := d.entryBytes(file, e)
+	if err != nil {
+		return image.Config{}, d.entryError(i, err)
+	}
+	cfg, err := d.entryConfig(e, entryData)
+	if err != nil {
+		return image.Config{}, d.entryError(i, err)
+	}
+	return cfg, nil
+}
+
+// entryInfo describes e from its directory fields and the header at the
+// start of its payload.
+func (d *decoder) entryInfo(e *direntry, payload []byte) (EntryInfo, error) {
+	info := EntryInfo{
+		Width:  int(e.Width),
+		Height: int(e.Height),
+		Colors: int(e.Palette),
+		Planes: int(e.Plane),
+		Bits:   int(e.Bits),
+		Offset: int64(e.Offset),
+		Size:   int64(e.Size),
+	}
+	if info.Width == 0 || info.Height == 0 {
+		info.Width, info.Height = largeSize(e, payload)
+	}
+	if d.head.Type == typeCursor {
+		info.Hotspot = e.hotspot()
+	}
+
+	if isPNG(payload) {
+		info.Format = FormatPNG
+		return info, parsePNGInfo(&info, payload)
+	}
+	info.Format = FormatBMP
+	return info, parseDIBInfo(&info, e, payload)
+}
+
+// largeSize returns the dimensions of an entry whose directory width or
+// height is 0: the size in the PNG header for PNG entries, 256 otherwise.
+func largeSize(e *direntry, data []byte) (w, h int) {
+	w, h = int(e.Width), int(e.Height)
+	var info EntryInfo
+	if isPNG(data) && parsePNGInfo(&info, data) == nil {
+		if w == 0 && info.ImageWidth > 0 {
+			w = info.ImageWidth
+		}
+		if h == 0 && info.ImageHeight > 0 {
+			h = info.ImageHeight
+		}
+	}
+	if w == 0 {
+		w = 256
+	}
+	if h == 0 {
+		h = 256
+	}
+	return w, h
+}
+
+// entryConfig returns the image.Config of e from the headers of its
+// payload. Paletted entries report their palette as the color model; all
+// other DIB entries decode to NRGBA.
+func (d *decoder) entryConfig(e *direntry, payload []byte) (image.Config, error) {
+	if isPNG(payload) {
+		cfg, err := png.DecodeConfig(bytes.NewReader(payload))
+		if err != nil {
+			return image.Config{}, formatError(err, "invalid png payload")
+		}
+		return cfg, nil
+	}
+
+	h, err := parseDIBHeader(payload, e)
+	if err != nil {
+		return image.Config{}, err
+	}
+	cfg := image.Config{
+		ColorModel: color.NRGBAModel,
+		Width:      h.width,
+		Height:     h.height,
+	}
+	switch h.bits {
+	case 1, 2, 4, 8:
+		pal, err := dibPalette(payload, &h)
+		if err != nil {
+			return image.Config{}, err
+		}
+		cfg.ColorModel = pal
+	}
+	return cfg, nil
+}
+
+func isPNG(payload []byte) bool {
+	return len(payload) >= len(pngHeader) && bytes.Equal(payload[:len(pngHeader)], pngHeader)
+}
+
+// parsePNGInfo fills in the image fields of info from the IHDR chunk, which
+// the PNG specification requires to come first.
+func parsePNGInfo(info *EntryInfo, payload []byte) error {
+	const ihdrEnd = 8 + 8 + 13 // signature, chunk length and type, IHDR data
+	if len(payload) < ihdrEnd {
+		return truncated("png header")
+	}
+	if string(payload[12:16]) != "IHDR" {
+		return formatError(nil, "corrupted png entry (missing IHDR)")
+	}
+
+	info.ImageWidth = int(binary.BigEndian.Uint32(payload[16:20]))
+	info.ImageHeight = int(binary.BigEndian.Uint32(payload[20:24]))
+
+	depth := int(payload[24])
+	switch payload[25] { // colour type
+	case 0, 3: // greyscale, paletted
+		info.ImageBits = depth
+	case 2: // RGB
+		info.ImageBits = 3 * depth
+	case 4: // greyscale with alpha
+		info.ImageBits = 2 * depth
+	case 6: // RGBA
+		info.ImageBits = 4 * depth
+	default:
+		return formatError(nil, "corrupted png entry (colour type %d)", payload[25])
+	}
+	return nil
+}
+
+// parseDIBInfo fills in the image fields of info from the DIB header.
+func parseDIBInfo(info *EntryInfo, e *direntry, payload []byte) error {
+	h, err := parseDIBHeader(payload, e)
+	if err != nil {
+		return err
+	}
+	info.ImageWidth = h.width
+	info.ImageHeight = h.height
+	info.ImageBits = h.bits
+	return nil
+}
@@ -0,0 +1,153 @@
+package ico
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"testing"
+)
+
+// TestReadDirectory tests directory inspection of the fixture files
+func TestReadDirectory(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		file string
+		want []EntryInfo
+	}{
+		{
+			file: "testdata/multi_sizes.ico",
+			want: []EntryInfo{
+				{Width: 16, Height: 16, Planes: 1, Bits: 32, Offset: 70, Size: 102, Format: FormatPNG, ImageWidth: 16, ImageHeight: 16, ImageBits: 24},
+				{Width: 32, Height: 32, Planes: 1, Bits: 32, Offset: 172, Size: 122, Format: FormatPNG, ImageWidth: 32, ImageHeight: 32, ImageBits: 24},
+				{Width: 48, Height: 48, Planes: 1, Bits: 32, Offset: 294, Size: 187, Format: FormatPNG, ImageWidth: 48, ImageHeight: 48, ImageBits: 24},
+				{Width: 256, Height: 256, Planes: 1, Bits: 32, Offset: 481, Size: 818, Format: FormatPNG, ImageWidth: 256, ImageHeight: 256, ImageBits: 24},
+			},
+		},
+		{
+			file: "testdata/bmp_format.ico",
+			want: []EntryInfo{
+				{Width: 32, Height: 32, Planes: 1, Bits: 32, Offset: 22, Size: 4264, Format: FormatBMP, ImageWidth: 32, ImageHeight: 32, ImageBits: 32},
+			},
+		},
+		{
+			file: "testdata/4bit.ico",
+			want: []EntryInfo{
+				{Width: 32, Height: 32, Colors: 16, Planes: 1, Bits: 4, Offset: 22, Size: 744, Format: FormatBMP, ImageWidth: 32, ImageHeight: 32, ImageBits: 4},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.file, func(t *testing.T) {
+			t.Parallel()
+
+			reader, err := os.Open(tc.file)
+			if err != nil {
+				t.Fatalf("failed to open test file: %v", err)
+			}
+			defer reader.Close()
+
+			infos, err := ReadDirectory(reader)
+			if err != nil {
+				t.Fatalf("failed to read directory: %v", err)
+			}
+			if len(infos) != len(tc.want) {
+				t.Fatalf("expected %d entries, got %d", len(tc.want), len(infos))
+			}
+			for i := range infos {
+				if infos[i] != tc.want[i] {
+					t.Errorf("entry %d:\n got %+v\nwant %+v", i, infos[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestReadDirectoryCursor tests that cursor hotspots are reported
+func TestReadDirectoryCursor(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	err := EncodeAllCursors(&buf, []Cursor{
+		{Image: createMaskedImage(32), Hotspot: image.Pt(4, 9)},
+		{Image: createMaskedImage(256), Hotspot: image.Pt(100, 200)},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+
+	infos, err := ReadDirectory(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	want := []struct {
+		hotspot image.Point
+		format  Format
+		size    int
+	}{
+		{image.Pt(4, 9), FormatBMP, 32},
+		{image.Pt(100, 200), FormatPNG, 256},
+	}
+	for i, w := range want {
+		info := infos[i]
+		if info.Hotspot != w.hotspot || info.Format != w.format {
+			t.Errorf("entry %d: hotspot %v format %v, want %v %v", i, info.Hotspot, info.Format, w.hotspot, w.format)
+		}
+		if info.Width != w.size || info.ImageWidth != w.size || info.ImageHeight != w.size {
+			t.Errorf("entry %d: sizes %dx%d / %dx%d, want %d", i, info.Width, info.Height, info.ImageWidth, info.ImageHeight, w.size)
+		}
+	}
+}
+
+// TestReadDirectoryErrors tests error handling for invalid files
+func TestReadDirectoryErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, file := range []string{
+		"testdata/empty.ico",
+		"testdata/corrupt_header.ico",
+		"testdata/truncated.ico",
+		"testdata/invalid_size.ico",
+		"testdata/bad_offset.ico",
+	} {
+		reader, err := os.Open(file)
+		if err != nil {
+			t.Fatalf("failed to open test file: %v", err)
+		}
+		if _, err := ReadDirectory(reader); err == nil {
+			t.Errorf("%s: expected error, got nil", file)
+		}
+		reader.Close()
+	}
+}
+
+// TestReadDirectoryZeroSizePNG tests that a PNG entry stored with a 0
+// directory size reports the size of its PNG header
+func TestReadDirectoryZeroSizePNG(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	if err := (&Encoder{Format: FormatPNG}).Encode(&buf, createMaskedImage(128)); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	data := buf.Bytes()
+	data[headSize], data[headSize+1] = 0, 0
+
+	infos, err := ReadDirectory(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	if infos[0].Width != 128 || infos[0].Height != 128 {
+		t.Errorf("expected 128x128, got %dx%d", infos[0].Width, infos[0].Height)
+	}
+
+	ic, err := ParseIcon(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if e := ic.Entries[0]; e.Width != 128 || e.Height != 128 {
+		t.Errorf("expected parsed entry 128x128, got %dx%d", e.Width, e.Height)
+	}
+}
@@ -0,0 +1,119 @@
+package ico
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	// ErrFormat matches every *FormatError under errors.Is.
+	ErrFormat = errors.New("ico: invalid format")
+	// ErrNoImages is returned for files whose directory is empty, and when
+	// asked to encode no images.
+	ErrNoImages = errors.New("ico: no images")
+	// ErrLimitExceeded matches every *LimitError under errors.Is.
+	ErrLimitExceeded = errors.New("ico: limit exceeded")
+	// ErrNotCursor is returned by the cursor decoders for .ico files.
+	ErrNotCursor = errors.New("ico: not a cursor file")
+	// ErrNoMatch is wrapped by errors reporting that no entry satisfies a
+	// selection.
+	ErrNoMatch = errors.New("ico: no matching entry")
+)
+
+// A FormatError reports malformed input, locating the problem as precisely
+// as the decoder can.
+type FormatError struct {
+	// Entry is the index of the directory entry concerned, or -1 if the
+	// problem is with the file header.
+	Entry int
+	// Offset is the byte offset in the file of the structure concerned: the
+	// header, the directory entry or the entry payload. It is -1 if unknown.
+	Offset int64
+	// Reason describes the problem.
+	Reason string
+	// Err is the underlying error, if any, such as io.ErrUnexpectedEOF for
+	// truncated data or the error of the PNG decoder.
+	Err error
+}
+
+func (e *FormatError) Error() string {
+	var b strings.Builder
+	b.WriteString("ico: ")
+	if e.Entry >= 0 {
+		fmt.Fprintf(&b, "entry %d: ", e.Entry)
+	}
+	b.WriteString(e.Reason)
+	if e.Offset >= 0 {
+		fmt.Fprintf(&b, " at offset %d", e.Offset)
+	}
+	if e.Err != nil {
+		b.WriteString(": ")
+		b.WriteString(strings.TrimPrefix(e.Err.Error(), "ico: "))
+	}
+	return b.String()
+}
+
+func (e *FormatError) Unwrap() error { return e.Err }
+
+func (e *FormatError) Is(target error) bool { return target == ErrFormat }
+
+// A LimitError reports input exceeding a Decoder limit.
+type LimitError struct {
+	// Entry is the index of the directory entry concerned, or -1 if the
+	// limit applies to the file as a whole.
+	Entry int
+	// Reason describes the limit and by how much it was exceeded.
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	if e.Entry >= 0 {
+		return fmt.Sprintf("ico: entry %d: limit exceeded: %s", e.Entry, e.Reason)
+	}
+	return "ico: limit exceeded: " + e.Reason
+}
+
+func (e *LimitError) Is(target error) bool { return target == ErrLimitExceeded }
+
+// formatError returns a FormatError that entryError later ties to an entry
+// and offset.
+func formatError(err error, format string, args ...interface{}) *FormatError {
+	return &FormatError{Entry: -1, Offset: -1, Reason: fmt.Sprintf(format, args...), Err: err}
+}
+
+// truncated reports that the named structure runs past the end of its data.
+func truncated(what string) *FormatError {
+	return formatError(io.ErrUnexpectedEOF, "truncated %s", what)
+}
+
+// limitError reports input exceeding a Decoder limit. entryError later
+// ties it to an entry if there is one.
+func limitError(format string, args ...interface{}) *LimitError {
+	return &LimitError{Entry: -1, Reason: fmt.Sprintf(format, args...)}
+}
+
+// entryError attributes err, raised while handling entry i, to that entry
+// and, unless it already has one, to the offset of its payload. Entries of
+// an Icon have no file offset, leaving Offset at -1.
+func (d *decoder) entryError(i int, err error) error {
+	var le *LimitError
+	if errors.As(err, &le) {
+		if le.Entry < 0 {
+			le.Entry = i
+		}
+		return le
+	}
+	var fe *FormatError
+	if !errors.As(err, &fe) {
+		fe = formatError(err, "invalid entry")
+	}
+	if fe.Entry < 0 {
+		fe.Entry = i
+	}
+	if fe.Offset < 0 && i < len(d.entries) {
+		fe.Offset = int64(d.entries[i].Offset)
+	}
+	return fe
+}
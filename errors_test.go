@@ -0,0 +1,129 @@
+package ico
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// TestFormatError tests that decoding errors locate the problem and match
+// the exported sentinels
+func TestFormatError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		file       string
+		entry      int
+		offset     int64
+		unexpected bool
+	}{
+		{"corrupt header", "testdata/corrupt_header.ico", -1, 0, false},
+		{"truncated", "testdata/truncated.ico", 0, 22, true},
+		{"invalid size", "testdata/invalid_size.ico", 0, 22, false},
+		{"bad offset", "testdata/bad_offset.ico", 0, 10000, true},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := os.ReadFile(tc.file)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", tc.file, err)
+			}
+			_, err = Decode(bytes.NewReader(data))
+			if !errors.Is(err, ErrFormat) {
+				t.Fatalf("expected ErrFormat, got %v", err)
+			}
+			var fe *FormatError
+			if !errors.As(err, &fe) {
+				t.Fatalf("expected *FormatError, got %T", err)
+			}
+			if fe.Entry != tc.entry || fe.Offset != tc.offset {
+				t.Errorf("expected entry %d at offset %d, got entry %d at offset %d", tc.entry, tc.offset, fe.Entry, fe.Offset)
+			}
+			if got := errors.Is(err, io.ErrUnexpectedEOF); got != tc.unexpected {
+				t.Errorf("expected errors.Is(err, io.ErrUnexpectedEOF) = %v, got %v", tc.unexpected, got)
+			}
+		})
+	}
+}
+
+// TestFormatErrorTruncatedDirectory tests the location reported for a
+// directory cut short
+func TestFormatErrorTruncatedDirectory(t *testing.T) {
+	t.Parallel()
+
+	data, err := os.ReadFile("testdata/16x16.ico")
+	if err != nil {
+		t.Fatalf("failed to read 16x16.ico: %v", err)
+	}
+	_, err = ReadDirectory(bytes.NewReader(data[:headSize+4]))
+	var fe *FormatError
+	if !errors.As(err, &fe) {
+		t.Fatalf("expected *FormatError, got %v", err)
+	}
+	if fe.Entry != 0 || fe.Offset != headSize {
+		t.Errorf("expected entry 0 at offset %d, got entry %d at offset %d", headSize, fe.Entry, fe.Offset)
+	}
+}
+
+// TestSentinelErrors tests the sentinels returned outside of FormatError
+func TestSentinelErrors(t *testing.T) {
+	t.Parallel()
+
+	icon, err := os.ReadFile("testdata/multi_sizes.ico")
+	if err != nil {
+		t.Fatalf("failed to read multi_sizes.ico: %v", err)
+	}
+	empty, err := os.ReadFile("testdata/empty.ico")
+	if err != nil {
+		t.Fatalf("failed to read empty.ico: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		err  func() error
+		want error
+	}{
+		{"no images", func() error {
+			_, err := Decode(bytes.NewReader(empty))
+			return err
+		}, ErrNoImages},
+		{"encode no images", func() error {
+			return EncodeAll(io.Discard, nil)
+		}, ErrNoImages},
+		{"not a cursor", func() error {
+			_, err := DecodeCursor(bytes.NewReader(icon))
+			return err
+		}, ErrNotCursor},
+		{"no match", func() error {
+			_, err := DecodeBestBy(bytes.NewReader(icon), 24, 24, SelectExact)
+			return err
+		}, ErrNoMatch},
+		{"limit exceeded", func() error {
+			dec := Decoder{MaxEntries: 1}
+			_, err := dec.DecodeAll(bytes.NewReader(icon))
+			return err
+		}, ErrLimitExceeded},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.err()
+			if !errors.Is(err, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, err)
+			}
+			if errors.Is(err, ErrFormat) {
+				t.Errorf("expected no ErrFormat, got %v", err)
+			}
+		})
+	}
+}
@@ -1,5 +1,3 @@
 module github.com/antoinefink/golang-ico
 
 go 1.23.2
-
-require github.com/jsummers/gobmp v0.0.0-20230614200233-a9de23ed2e25
@@ -0,0 +1,515 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+)
+
+// ErrJPEG2000 is returned for ICNS entries stored as JPEG 2000, which the
+// package cannot decode.
+var ErrJPEG2000 = errors.New("ico: JPEG 2000 icns entries are not supported")
+
+const icnsHeaderSize = 8 // magic and length, as for each element
+
+// Storage is how an ICNS entry stores its image, as reported in
+// EntryInfo.Storage.
+type Storage string
+
+const (
+	// StoragePNG entries hold a PNG stream.
+	StoragePNG Storage = "png"
+	// StoragePackBits entries hold legacy run-length packed RGB channels
+	// with a separate 8-bit mask, or ARGB channels.
+	StoragePackBits Storage = "packbits"
+	// StorageJPEG2000 entries hold JPEG 2000 data, which the package
+	// cannot decode.
+	StorageJPEG2000 Storage = "jpeg2000"
+)
+
+// An icnsType describes an ICNS image element type.
+type icnsType struct {
+	size  int // in points
+	scale int // pixels per point
+	// mask is the type of the 8-bit mask of legacy RGB elements.
+	mask string
+}
+
+// icnsTypes lists the ICNS image element types the package reads. ic04 and
+// ic05 hold ARGB or PNG data, is32 to it32 legacy RGB, the rest PNG or
+// JPEG 2000.
+var icnsTypes = map[string]icnsType{
+	"icp4": {16, 1, ""},
+	"icp5": {32, 1, ""},
+	"icp6": {64, 1, ""},
+	"ic07": {128, 1, ""},
+	"ic08": {256, 1, ""},
+	"ic09": {512, 1, ""},
+	"ic10": {512, 2, ""},
+	"ic11": {16, 2, ""},
+	"ic12": {32, 2, ""},
+	"ic13": {128, 2, ""},
+	"ic14": {256, 2, ""},
+	"ic04": {16, 1, ""},
+	"ic05": {32, 1, ""},
+	"is32": {16, 1, "s8mk"},
+	"il32": {32, 1, "l8mk"},
+	"ih32": {48, 1, "h8mk"},
+	"it32": {128, 1, "t8mk"},
+}
+
+// pixels returns the width and height of the type in pixels.
+func (t icnsType) pixels() int {
+	return t.size * t.scale
+}
+
+var (
+	jp2Signature       = []byte("\x00\x00\x00\x0cjP  \r\n\x87\n")
+	j2kCodestreamStart = []byte("\xff\x4f\xff\x51")
+)
+
+// An icnsElement is one element of an ICNS file.
+type icnsElement struct {
+	typ  string
+	data []byte
+	// offset is the position of the element data in the file.
+	offset int64
+}
+
+// icnsDecoder holds a parsed ICNS file.
+type icnsDecoder struct {
+	limits   Decoder
+	elements []icnsElement
+	// images indexes the image elements in elements.
+	images []int
+}
+
+// ReadICNSDirectory returns a description of every image of the Apple icon
+// (.icns) file in r, reading only element headers and PNG IHDR chunks. The
+// 8-bit masks of legacy RGB entries are not listed separately.
+func ReadICNSDirectory(r io.Reader) ([]EntryInfo, error) {
+	var dec Decoder
+	return dec.ReadICNSDirectory(r)
+}
+
+// DecodeICNS returns the largest image of the .icns file in r, preferring
+// PNG entries among those of equal size. JPEG 2000 entries are skipped; it
+// fails with ErrJPEG2000 only if every entry is JPEG 2000.
+func DecodeICNS(r io.Reader) (image.Image, error) {
+	var dec Decoder
+	return dec.DecodeICNS(r)
+}
+
+// DecodeAllICNS returns every image of the .icns file in r, in file order.
+// It fails with ErrJPEG2000 if any entry is JPEG 2000.
+func DecodeAllICNS(r io.Reader) ([]image.Image, error) {
+	var dec Decoder
+	return dec.DecodeAllICNS(r)
+}
+
+// ReadICNSDirectory is like the package-level ReadICNSDirectory but applies
+// dec's file size and entry count limits.
+func (dec *Decoder) ReadICNSDirectory(r io.Reader) ([]EntryInfo, error) {
+	d := icnsDecoder{limits: *dec}
+	if err := d.parse(r); err != nil {
+		return nil, err
+	}
+	return d.infos()
+}
+
+// DecodeICNS is like the package-level DecodeICNS but applies dec's limits.
+func (dec *Decoder) DecodeICNS(r io.Reader) (image.Image, error) {
+	d := icnsDecoder{limits: *dec}
+	if err := d.parse(r); err != nil {
+		return nil, err
+	}
+	infos, err := d.infos()
+	if err != nil {
+		return nil, err
+	}
+
+	best := -1
+	for i := range infos {
+		a := &infos[i]
+		if a.Storage == StorageJPEG2000 {
+			continue
+		}
+		if best < 0 {
+			best = i
+			continue
+		}
+		b := &infos[best]
+		if areaA, areaB := a.ImageWidth*a.ImageHeight, b.ImageWidth*b.ImageHeight; areaA > areaB ||
+			areaA == areaB && a.Storage == StoragePNG && b.Storage != StoragePNG {
+			best = i
+		}
+	}
+	if best < 0 {
+		// Every entry is JPEG 2000: report the first.
+		return d.decodeImage(0, &infos[0])
+	}
+	dd := decoder{limits: *dec}
+	if err := dd.checkPixels(infos[best : best+1]); err != nil {
+		return nil, err
+	}
+	return d.decodeImage(best, &infos[best])
+}
+
+// DecodeAllICNS is like the package-level DecodeAllICNS but applies dec's
+// limits.
+func (dec *Decoder) DecodeAllICNS(r io.Reader) ([]image.Image, error) {
+	d := icnsDecoder{limits: *dec}
+	if err := d.parse(r); err != nil {
+		return nil, err
+	}
+	infos, err := d.infos()
+	if err != nil {
+		return nil, err
+	}
+	dd := decoder{limits: *dec}
+	if err := dd.checkPixels(infos); err != nil {
+		return nil, err
+	}
+
+	imgs := make([]image.Image, len(infos))
+	for i := range infos {
+		if imgs[i], err = d.decodeImage(i, &infos[i]); err != nil {
+			return nil, err
+		}
+	}
+	return imgs, nil
+}
+
+// parse reads the file and splits it into elements.
+func (d *icnsDecoder) parse(r io.Reader) error {
+	file, err := readAllICO(r, limit(d.limits.MaxFileSize, DefaultMaxFileSize))
+	if err != nil {
+		return err
+	}
+	if len(file) < icnsHeaderSize {
+		return &FormatError{Entry: -1, Offset: 0, Reason: "truncated icns header", Err: io.ErrUnexpectedEOF}
+	}
+	if string(file[:4]) != "icns" {
+		return &FormatError{Entry: -1, Offset: 0, Reason: fmt.Sprintf("corrupted icns magic %q", file[:4])}
+	}
+	end := int64(binary.BigEndian.Uint32(file[4:8]))
+	if end < icnsHeaderSize || end > int64(len(file)) {
+		return &FormatError{Entry: -1, Offset: 4, Reason: fmt.Sprintf("corrupted icns length %d for %d-byte file", end, len(file))}
+	}
+
+	maxEntries := limit(int64(d.limits.MaxEntries), DefaultMaxEntries)
+	for off := int64(icnsHeaderSize); off < end; {
+		if end-off < icnsHeaderSize {
+			return &FormatError{Entry: -1, Offset: off, Reason: "truncated icns element header", Err: io.ErrUnexpectedEOF}
+		}
+		typ := string(file[off : off+4])
+		size := int64(binary.BigEndian.Uint32(file[off+4:]))
+		if size < icnsHeaderSize || off+size > end {
+			return &FormatError{Entry: -1, Offset: off, Reason: fmt.Sprintf("corrupted icns element %q (length %d)", typ, size), Err: io.ErrUnexpectedEOF}
+		}
+		if _, ok := icnsTypes[typ]; ok {
+			if n := int64(len(d.images)) + 1; n > maxEntries {
+				return limitError("too many entries (%d > %d)", n, maxEntries)
+			}
+			d.images = append(d.images, len(d.elements))
+		}
+		d.elements = append(d.elements, icnsElement{typ: typ, data: file[off+icnsHeaderSize : off+size], offset: off + icnsHeaderSize})
+		off += size
+	}
+	if len(d.images) == 0 {
+		return ErrNoImages
+	}
+	return nil
+}
+
+// infos describes every image element.
+func (d *icnsDecoder) infos() ([]EntryInfo, error) {
+	infos := make([]EntryInfo, len(d.images))
+	for i, j := range d.images {
+		el := &d.elements[j]
+		t := icnsTypes[el.typ]
+		info := EntryInfo{
+			Width:       t.pixels(),
+			Height:      t.pixels(),
+			Offset:      el.offset,
+			Size:        int64(len(el.data)),
+			Type:        el.typ,
+			ImageWidth:  t.pixels(),
+			ImageHeight: t.pixels(),
+			ImageBits:   32,
+		}
+		switch {
+		case isPNG(el.data):
+			info.Storage = StoragePNG
+			if err := parsePNGInfo(&info, el.data); err != nil {
+				return nil, d.entryError(i, err)
+			}
+		case bytes.HasPrefix(el.data, jp2Signature) || bytes.HasPrefix(el.data, j2kCodestreamStart):
+			info.Storage = StorageJPEG2000
+		case t.mask != "" || el.typ == "ic04" || el.typ == "ic05":
+			info.Storage = StoragePackBits
+			if t.mask != "" && d.element(t.mask) == nil {
+				info.ImageBits = 24
+			}
+		default:
+			return nil, d.entryError(i, formatError(nil, "unknown %s payload", el.typ))
+		}
+		infos[i] = info
+	}
+	return infos, nil
+}
+
+// element returns the first element of the given type, or nil.
+func (d *icnsDecoder) element(typ string) *icnsElement {
+	for i := range d.elements {
+		if d.elements[i].typ == typ {
+			return &d.elements[i]
+		}
+	}
+	return nil
+}
+
+// entryError attributes err to image i, as decoder.entryError does.
+func (d *icnsDecoder) entryError(i int, err error) error {
+	var fe *FormatError
+	if !errors.As(err, &fe) {
+		fe = formatError(err, "invalid entry")
+	}
+	if fe.Entry < 0 {
+		fe.Entry = i
+	}
+	if fe.Offset < 0 {
+		fe.Offset = d.elements[d.images[i]].offset
+	}
+	return fe
+}
+
+// decodeImage decodes image i, described by info.
+func (d *icnsDecoder) decodeImage(i int, info *EntryInfo) (image.Image, error) {
+	el := &d.elements[d.images[i]]
+	switch info.Storage {
+	case StoragePNG:
+		img, err := png.Decode(bytes.NewReader(el.data))
+		if err != nil {
+			return nil, d.entryError(i, formatError(err, "invalid png payload"))
+		}
+		return img, nil
+	case StorageJPEG2000:
+		return nil, d.entryError(i, formatError(ErrJPEG2000, "%s payload", el.typ))
+	}
+
+	n := info.ImageWidth
+	img := image.NewNRGBA(image.Rect(0, 0, n, n))
+	data := el.data
+	channels := 3
+	if el.typ == "ic04" || el.typ == "ic05" {
+		if !bytes.HasPrefix(data, []byte("ARGB")) {
+			return nil, d.entryError(i, formatError(nil, "missing ARGB signature"))
+		}
+		data, channels = data[4:], 4
+	} else if el.typ == "it32" && bytes.HasPrefix(data, []byte{0, 0, 0, 0}) {
+		data = data[4:]
+	}
+
+	var planes []byte
+	if channels == 3 && len(data) == 4*n*n {
+		// Legacy RGB elements may be stored unpacked, one unused byte
+		// before each pixel.
+		planes = make([]byte, 3*n*n)
+		for p := 0; p < n*n; p++ {
+			for c := 0; c < 3; c++ {
+				planes[c*n*n+p] = data[p*4+1+c]
+			}
+		}
+	} else {
+		var err error
+		if planes, err = unpackICNS(data, channels*n*n); err != nil {
+			return nil, d.entryError(i, err)
+		}
+	}
+
+	// ARGB elements store alpha first; RGB ones take it from their mask.
+	var alpha, rgb []byte
+	if channels == 4 {
+		alpha, rgb = planes[:n*n], planes[n*n:]
+	} else {
+		rgb = planes
+		if m := d.element(icnsTypes[el.typ].mask); m != nil {
+			if len(m.data) < n*n {
+				return nil, d.entryError(i, truncated(m.typ+" mask"))
+			}
+			alpha = m.data[:n*n]
+		}
+	}
+	for p := 0; p < n*n; p++ {
+		px := img.Pix[p*4 : p*4+4 : p*4+4]
+		px[0], px[1], px[2], px[3] = rgb[p], rgb[n*n+p], rgb[2*n*n+p], 0xff
+		if alpha != nil {
+			px[3] = alpha[p]
+		}
+	}
+	return img, nil
+}
+
+// unpackICNS expands the run-length packing of legacy ICNS channels: a
+// header byte below 0x80 copies the next n+1 bytes, one from 0x80 up
+// repeats the next byte n-0x80+3 times.
+func unpackICNS(data []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	for i := 0; len(out) < size; {
+		if i >= len(data) {
+			return nil, truncated("packed icns data")
+		}
+		n := int(data[i])
+		i++
+		if n < 0x80 {
+			n++
+			if i+n > len(data) {
+				return nil, truncated("packed icns data")
+			}
+			out = append(out, data[i:i+n]...)
+			i += n
+			continue
+		}
+		if i >= len(data) {
+			return nil, truncated("packed icns data")
+		}
+		for k := n - 0x80 + 3; k > 0; k-- {
+			out = append(out, data[i])
+		}
+		i++
+	}
+	if len(out) > size {
+		return nil, formatError(nil, "packed icns data overruns %d bytes", size)
+	}
+	return out, nil
+}
+
+// DefaultICNSSizes is the size ladder used by EncodeICNSSizes when none is
+// given, matching the images iconutil expects in an .iconset.
+var DefaultICNSSizes = []int{16, 32, 64, 128, 256, 512, 1024}
+
+// icnsWriteTypes maps a pixel size to the ICNS types written for it: the
+// 1x type first, then the @2x type of half the size in points, if any.
+var icnsWriteTypes = map[int][]string{
+	16:   {"icp4"},
+	32:   {"icp5", "ic11"},
+	64:   {"icp6", "ic12"},
+	128:  {"ic07"},
+	256:  {"ic08", "ic13"},
+	512:  {"ic09", "ic14"},
+	1024: {"ic10"},
+}
+
+// EncodeICNS writes imgs to w as an Apple icon (.icns) file holding one PNG
+// entry per image, preceded by a table of contents. It accepts the same
+// images as EncodeAll: those that are not square with a side in
+// DefaultICNSSizes, such as the 24 and 48 pixel entries of DefaultSizes,
+// have no ICNS type and are dropped. No two images may share a size. Sizes
+// that serve as both a 1x and a @2x entry, such as 32x32 for 32pt and
+// 16pt@2x, are written under both types.
+func EncodeICNS(w io.Writer, imgs []image.Image) error {
+	if len(imgs) == 0 {
+		return ErrNoImages
+	}
+
+	type element struct {
+		typ  string
+		data []byte
+	}
+	var elements []element
+	seen := make(map[int]bool)
+	for _, im := range imgs {
+		b := im.Bounds()
+		types := icnsWriteTypes[b.Dx()]
+		if b.Dx() != b.Dy() || types == nil {
+			continue
+		}
+		if seen[b.Dx()] {
+			return fmt.Errorf("ico: duplicate %dx%d icns image", b.Dx(), b.Dy())
+		}
+		seen[b.Dx()] = true
+
+		data, err := encodePNG(im)
+		if err != nil {
+			return err
+		}
+		for _, typ := range types {
+			elements = append(elements, element{typ, data})
+		}
+	}
+	if len(elements) == 0 {
+		return errors.New("ico: no image has an icns size")
+	}
+
+	toc := make([]byte, 0, icnsHeaderSize*len(elements))
+	size := int64(icnsHeaderSize + icnsHeaderSize + cap(toc))
+	for _, el := range elements {
+		n := int64(icnsHeaderSize + len(el.data))
+		toc = binary.BigEndian.AppendUint32(append(toc, el.typ...), uint32(n))
+		if size += n; size > math.MaxUint32 {
+			return errors.New("ico: encoded file too large")
+		}
+	}
+
+	bb := new(bytes.Buffer)
+	writeICNSHeader(bb, "icns", int(size)-icnsHeaderSize)
+	writeICNSHeader(bb, "TOC ", len(toc))
+	bb.Write(toc)
+	if _, err := w.Write(bb.Bytes()); err != nil {
+		return err
+	}
+	for _, el := range elements {
+		bb.Reset()
+		writeICNSHeader(bb, el.typ, len(el.data))
+		if _, err := w.Write(bb.Bytes()); err != nil {
+			return err
+		}
+		if _, err := w.Write(el.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncodeICNSSizes scales master to each of the given square sizes, as
+// EncodeSizes does, and writes the results to w as one .icns file. A nil
+// sizes uses DefaultICNSSizes; sizes without an ICNS type are dropped, as
+// in EncodeICNS.
+func EncodeICNSSizes(w io.Writer, master image.Image, sizes []int) error {
+	if sizes == nil {
+		sizes = DefaultICNSSizes
+	}
+	var kept []int
+	for _, size := range sizes {
+		if icnsWriteTypes[size] != nil {
+			kept = append(kept, size)
+		}
+	}
+	if len(kept) == 0 {
+		return fmt.Errorf("ico: no icns size in %v", sizes)
+	}
+	sizes = kept
+	if b := master.Bounds(); b.Empty() {
+		return fmt.Errorf("ico: invalid image size %dx%d", b.Dx(), b.Dy())
+	}
+
+	src := newPremultiplied(master)
+	imgs := make([]image.Image, len(sizes))
+	for i, size := range sizes {
+		imgs[i] = src.fitSquare(size)
+	}
+	return EncodeICNS(w, imgs)
+}
+
+// writeICNSHeader writes the type and length of an element whose data is n
+// bytes long.
+func writeICNSHeader(b *bytes.Buffer, typ string, n int) {
+	b.WriteString(typ)
+	b.Write(binary.BigEndian.AppendUint32(nil, uint32(icnsHeaderSize+n)))
+}
@@ -0,0 +1,350 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// icnsElementBytes returns an ICNS element of the given type
+func icnsElementBytes(typ string, data []byte) []byte {
+	b := make([]byte, icnsHeaderSize, icnsHeaderSize+len(data))
+	copy(b, typ)
+	binary.BigEndian.PutUint32(b[4:], uint32(icnsHeaderSize+len(data)))
+	return append(b, data...)
+}
+
+// buildICNS assembles an .icns file from elements
+func buildICNS(elements ...[]byte) []byte {
+	var body []byte
+	for _, el := range elements {
+		body = append(body, el...)
+	}
+	return icnsElementBytes("icns", body)
+}
+
+// packICNSChannel packs a channel with one literal and one run per row
+func packICNSChannel(ch []byte, n int) []byte {
+	var out []byte
+	for y := 0; y < n; y++ {
+		row := ch[y*n : (y+1)*n]
+		out = append(out, 0x00, row[0])
+		out = append(out, byte(0x80+n-1-3), row[1]) // rows are uniform from x=1
+	}
+	return out
+}
+
+// TestDecodeICNS tests reading PNG and packed legacy entries
+func TestDecodeICNS(t *testing.T) {
+	t.Parallel()
+
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, createMaskedImage(64)); err != nil {
+		t.Fatalf("failed to encode png: %v", err)
+	}
+
+	// 32x32 legacy entry: column 0 red, the rest blue; alpha by row.
+	const n = 32
+	r, g, b, mask := make([]byte, n*n), make([]byte, n*n), make([]byte, n*n), make([]byte, n*n)
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if x == 0 {
+				r[y*n+x] = 0xff
+			} else {
+				b[y*n+x] = 0xff
+			}
+			mask[y*n+x] = byte(y * 8)
+		}
+	}
+	var packed []byte
+	for _, ch := range [][]byte{r, g, b} {
+		packed = append(packed, packICNSChannel(ch, n)...)
+	}
+
+	data := buildICNS(
+		icnsElementBytes("TOC ", make([]byte, 8)),
+		icnsElementBytes("il32", packed),
+		icnsElementBytes("l8mk", mask),
+		icnsElementBytes("icp6", pngBuf.Bytes()),
+	)
+
+	infos, err := ReadICNSDirectory(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(infos))
+	}
+	if i := infos[0]; i.Type != "il32" || i.Storage != StoragePackBits || i.Width != 32 || i.ImageBits != 32 || i.Size != int64(len(packed)) {
+		t.Errorf("unexpected il32 info: %+v", i)
+	}
+	if i := infos[1]; i.Type != "icp6" || i.Storage != StoragePNG || i.ImageWidth != 64 || i.ImageHeight != 64 {
+		t.Errorf("unexpected icp6 info: %+v", i)
+	}
+	if !bytes.Equal(data[infos[0].Offset:infos[0].Offset+infos[0].Size], packed) {
+		t.Error("il32 offset does not point at its data")
+	}
+
+	imgs, err := DecodeAllICNS(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if len(imgs) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(imgs))
+	}
+	if got := color.NRGBAModel.Convert(imgs[0].At(0, 3)); got != (color.NRGBA{0xff, 0, 0, 24}) {
+		t.Errorf("pixel (0,3): expected red with alpha 24, got %v", got)
+	}
+	if got := color.NRGBAModel.Convert(imgs[0].At(5, 31)); got != (color.NRGBA{0, 0, 0xff, 248}) {
+		t.Errorf("pixel (5,31): expected blue with alpha 248, got %v", got)
+	}
+	if diff, err := fastCompare(toNRGBAForWrite(imgs[1]), toNRGBAForWrite(createMaskedImage(64))); err != nil || diff != 0 {
+		t.Errorf("png entry does not round-trip: diff %d, %v", diff, err)
+	}
+
+	img, err := DecodeICNS(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode largest: %v", err)
+	}
+	if img.Bounds().Dx() != 64 {
+		t.Errorf("expected the 64x64 entry, got %v", img.Bounds())
+	}
+}
+
+// TestDecodeICNSRaw tests unpacked legacy RGB without a mask
+func TestDecodeICNSRaw(t *testing.T) {
+	t.Parallel()
+
+	raw := make([]byte, 4*16*16)
+	for p := 0; p < 16*16; p++ {
+		copy(raw[p*4:], []byte{0, 0x10, 0x20, 0x30})
+	}
+	data := buildICNS(icnsElementBytes("is32", raw))
+
+	infos, err := ReadICNSDirectory(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	if infos[0].ImageBits != 24 {
+		t.Errorf("expected 24 bits without mask, got %d", infos[0].ImageBits)
+	}
+	img, err := DecodeICNS(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if got := img.At(7, 7); got != (color.NRGBA{0x10, 0x20, 0x30, 0xff}) {
+		t.Errorf("expected opaque 102030, got %v", got)
+	}
+}
+
+// TestDecodeICNSJPEG2000 tests that JPEG 2000 entries are listed but not decoded
+func TestDecodeICNSJPEG2000(t *testing.T) {
+	t.Parallel()
+
+	data := buildICNS(icnsElementBytes("ic09", append(append([]byte{}, jp2Signature...), 0, 0, 0, 0)))
+
+	infos, err := ReadICNSDirectory(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	if infos[0].Storage != StorageJPEG2000 || infos[0].Width != 512 {
+		t.Errorf("unexpected info: %+v", infos[0])
+	}
+	if _, err := DecodeAllICNS(bytes.NewReader(data)); !errors.Is(err, ErrJPEG2000) {
+		t.Errorf("expected ErrJPEG2000, got %v", err)
+	}
+	_, err = DecodeICNS(bytes.NewReader(data))
+	var fe *FormatError
+	if !errors.Is(err, ErrJPEG2000) || !errors.As(err, &fe) || fe.Entry != 0 || fe.Offset != infos[0].Offset {
+		t.Errorf("expected ErrJPEG2000 at entry 0 offset %d, got %v", infos[0].Offset, err)
+	}
+	if strings.Count(err.Error(), "ico:") != 1 {
+		t.Errorf("expected a single ico: prefix, got %q", err)
+	}
+}
+
+// TestDecodeICNSSkipsJPEG2000 tests that a larger JPEG 2000 entry does not
+// hide a decodable PNG one
+func TestDecodeICNSSkipsJPEG2000(t *testing.T) {
+	t.Parallel()
+
+	png512, err := encodePNG(createMaskedImage(512))
+	if err != nil {
+		t.Fatalf("failed to encode png: %v", err)
+	}
+	data := buildICNS(
+		icnsElementBytes("ic09", png512),
+		icnsElementBytes("ic10", append(append([]byte{}, jp2Signature...), 0, 0, 0, 0)),
+	)
+
+	img, err := DecodeICNS(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if img.Bounds().Dx() != 512 {
+		t.Errorf("expected the 512x512 PNG entry, got %v", img.Bounds())
+	}
+}
+
+// TestDecodeICNSErrors tests malformed files and limits
+func TestDecodeICNSErrors(t *testing.T) {
+	t.Parallel()
+
+	overlong := buildICNS(icnsElementBytes("il32", []byte{1, 2}))
+	binary.BigEndian.PutUint32(overlong[12:], 100)
+
+	tests := []struct {
+		name string
+		data []byte
+		dec  Decoder
+		want error
+	}{
+		{"bad magic", []byte("icnx\x00\x00\x00\x08"), Decoder{}, ErrFormat},
+		{"short", []byte("icn"), Decoder{}, ErrFormat},
+		{"no images", buildICNS(icnsElementBytes("TOC ", nil)), Decoder{}, ErrNoImages},
+		{"element past end", overlong, Decoder{}, ErrFormat},
+		{"truncated packing", buildICNS(icnsElementBytes("il32", []byte{5, 1})), Decoder{}, ErrFormat},
+		{"too many entries", buildICNS(icnsElementBytes("is32", nil), icnsElementBytes("il32", nil)), Decoder{MaxEntries: 1}, ErrLimitExceeded},
+		{"too many pixels", buildICNS(icnsElementBytes("il32", make([]byte, 4*32*32))), Decoder{MaxPixelsPerEntry: 16 * 16}, ErrLimitExceeded},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := tc.dec.DecodeAllICNS(bytes.NewReader(tc.data)); !errors.Is(err, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+
+	var fe *FormatError
+	_, err := DecodeAllICNS(bytes.NewReader(buildICNS(icnsElementBytes("TOC ", nil), icnsElementBytes("il32", []byte{5, 1}))))
+	if !errors.As(err, &fe) || fe.Entry != 0 || fe.Offset != 24 {
+		t.Errorf("expected error at entry 0 offset 24, got %v", err)
+	}
+}
+
+// TestEncodeICNS tests writing types, the TOC and reading the result back
+func TestEncodeICNS(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	if err := EncodeICNSSizes(&buf, createMaskedImage(300), []int{16, 32, 1024}); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	data := buf.Bytes()
+	if string(data[:4]) != "icns" || binary.BigEndian.Uint32(data[4:]) != uint32(len(data)) {
+		t.Fatalf("bad header % x for %d bytes", data[:8], len(data))
+	}
+
+	infos, err := ReadICNSDirectory(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to read back: %v", err)
+	}
+	wantTypes := []string{"icp4", "icp5", "ic11", "ic10"}
+	wantSizes := []int{16, 32, 32, 1024}
+	if len(infos) != len(wantTypes) {
+		t.Fatalf("expected %d entries, got %+v", len(wantTypes), infos)
+	}
+	for i, info := range infos {
+		if info.Type != wantTypes[i] || info.ImageWidth != wantSizes[i] || info.Storage != StoragePNG {
+			t.Errorf("entry %d: expected %s %dpx png, got %+v", i, wantTypes[i], wantSizes[i], info)
+		}
+	}
+
+	// The TOC lists every element in order with its full length.
+	if string(data[8:12]) != "TOC " {
+		t.Fatalf("expected TOC first, got %q", data[8:12])
+	}
+	toc := data[16 : 8+binary.BigEndian.Uint32(data[12:])]
+	if len(toc) != 8*len(infos) {
+		t.Fatalf("expected %d TOC records, got %d bytes", len(infos), len(toc))
+	}
+	for i, info := range infos {
+		rec := toc[i*8 : i*8+8]
+		if string(rec[:4]) != info.Type || int64(binary.BigEndian.Uint32(rec[4:])) != info.Size+icnsHeaderSize {
+			t.Errorf("TOC record %d: got %q length %d for %+v", i, rec[:4], binary.BigEndian.Uint32(rec[4:]), info)
+		}
+	}
+
+	img, err := DecodeICNS(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if img.Bounds().Dx() != 1024 {
+		t.Errorf("expected the 1024x1024 entry, got %v", img.Bounds())
+	}
+}
+
+// TestEncodeICNSDefaultSizes tests that the ICO size ladder is accepted,
+// dropping the sizes without an ICNS type
+func TestEncodeICNSDefaultSizes(t *testing.T) {
+	t.Parallel()
+
+	imgs := make([]image.Image, len(DefaultSizes))
+	for i, size := range DefaultSizes {
+		imgs[i] = createMaskedImage(size)
+	}
+	var buf bytes.Buffer
+	if err := EncodeICNS(&buf, imgs); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+
+	infos, err := ReadICNSDirectory(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read back: %v", err)
+	}
+	wantTypes := []string{"icp4", "icp5", "ic11", "icp6", "ic12", "ic08", "ic13"}
+	wantSizes := []int{16, 32, 32, 64, 64, 256, 256}
+	if len(infos) != len(wantTypes) {
+		t.Fatalf("expected %d entries, got %+v", len(wantTypes), infos)
+	}
+	for i, info := range infos {
+		if info.Type != wantTypes[i] || info.ImageWidth != wantSizes[i] {
+			t.Errorf("entry %d: expected %s %dpx, got %+v", i, wantTypes[i], wantSizes[i], info)
+		}
+	}
+
+	buf.Reset()
+	if err := EncodeICNSSizes(&buf, createMaskedImage(300), DefaultSizes); err != nil {
+		t.Fatalf("failed to encode sizes: %v", err)
+	}
+	if infos, err := ReadICNSDirectory(bytes.NewReader(buf.Bytes())); err != nil || len(infos) != len(wantTypes) {
+		t.Errorf("expected %d entries, got %d (%v)", len(wantTypes), len(infos), err)
+	}
+}
+
+// TestEncodeICNSErrors tests rejected inputs
+func TestEncodeICNSErrors(t *testing.T) {
+	t.Parallel()
+
+	if err := EncodeICNS(new(bytes.Buffer), nil); !errors.Is(err, ErrNoImages) {
+		t.Errorf("expected ErrNoImages, got %v", err)
+	}
+	tests := []struct {
+		name string
+		imgs []image.Image
+	}{
+		{"unsupported size", []image.Image{createMaskedImage(48)}},
+		{"no supported size", []image.Image{createMaskedImage(24), createMaskedImage(48)}},
+		{"not square", []image.Image{image.NewNRGBA(image.Rect(0, 0, 32, 16))}},
+		{"duplicate size", []image.Image{createMaskedImage(32), createMaskedImage(32)}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if err := EncodeICNS(new(bytes.Buffer), tc.imgs); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+	if err := EncodeICNSSizes(new(bytes.Buffer), createMaskedImage(64), []int{24}); err == nil {
+		t.Error("expected an error for size 24")
+	}
+}
@@ -0,0 +1,237 @@
+package ico
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"math"
+)
+
+// An Icon is the structure of an icon or cursor file: its kind and its
+// directory entries with their payloads left encoded. Unlike DecodeAll,
+// which converts every entry, an Icon can be edited and written back with
+// Encode; a file that was parsed and left untouched is written back byte
+// for byte.
+type Icon struct {
+	// Cursor reports whether the file is a .cur file, in which case the
+	// Planes and Bits fields of each entry hold its hotspot.
+	Cursor bool
+	// Entries are the directory entries in file order.
+	Entries []Entry
+
+	// raw, parsed and parsedCursor record what ParseIcon read, letting
+	// Encode detect an untouched Icon.
+	raw          []byte
+	parsed       []Entry
+	parsedCursor bool
+}
+
+// An Entry is one directory entry of an Icon together with its payload.
+type Entry struct {
+	// Width and Height are the entry dimensions. They are stored in the
+	// directory as 0 from 256 up, larger sizes being allowed for PNG
+	// payloads only. A stored 0 is read back from the PNG header for PNG
+	// payloads.
+	Width, Height int
+	// Colors is the palette size recorded in the directory, 0 if none.
+	Colors int
+	// Planes and Bits are the raw directory fields, or the hotspot in
+	// cursor files.
+	Planes, Bits int
+	// Data is the PNG or DIB payload.
+	Data []byte
+}
+
+// ParseIcon reads the icon or cursor file in r without decoding any payload.
+func ParseIcon(r io.Reader) (*Icon, error) {
+	var dec Decoder
+	return dec.ParseIcon(r)
+}
+
+// ParseIcon is like the package-level ParseIcon but applies dec's file size
+// and entry count limits.
+func (dec *Decoder) ParseIcon(r io.Reader) (*Icon, error) {
+	d := decoder{limits: *dec}
+	file, err := d.decodeDirectory(r)
+	if err != nil {
+		return nil, err
+	}
+
+	ic := &Icon{
+		Cursor:  d.head.Type == typeCursor,
+		Entries: make([]Entry, len(d.entries)),
+		raw:     file,
+		parsed:  make([]Entry, len(d.entries)),
+	}
+	ic.parsedCursor = ic.Cursor
+	for i := range d.entries {
+		e := &(d.entries[i])
+		data, err := d.entryBytes(file, e)
+		if err != nil {
+			return nil, d.entryError(i, err)
+		}
+		ic.parsed[i] = Entry{
+			Width:  int(e.Width),
+			Height: int(e.Height),
+			Colors: int(e.Palette),
+			Planes: int(e.Plane),
+			Bits:   int(e.Bits),
+			Data:   data,
+		}
+		if e.Width == 0 || e.Height == 0 {
+			ic.parsed[i].Width, ic.parsed[i].Height = largeSize(e, data)
+		}
+		ic.Entries[i] = ic.parsed[i]
+		ic.Entries[i].Data = append([]byte(nil), data...)
+	}
+	return ic, nil
+}
+
+// NewEntry encodes the image of e as an Entry, applying e's settings and,
+// where those are unset, enc's.
+func (enc *Encoder) NewEntry(e EntryImage) (Entry, error) {
+	b := e.Image.Bounds()
+	de, data, err := enc.encodeEntry(e)
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{
+		Width:  b.Dx(),
+		Height: b.Dy(),
+		Colors: int(de.Palette),
+		Planes: int(de.Plane),
+		Bits:   int(de.Bits),
+		Data:   data,
+	}, nil
+}
+
+// Add appends e to the directory.
+func (ic *Icon) Add(e Entry) {
+	ic.Entries = append(ic.Entries, e)
+}
+
+// Remove deletes entry i.
+func (ic *Icon) Remove(i int) {
+	ic.Entries = append(ic.Entries[:i:i], ic.Entries[i+1:]...)
+}
+
+// Replace sets entry i to e.
+func (ic *Icon) Replace(i int, e Entry) {
+	ic.Entries[i] = e
+}
+
+// Move moves entry from to index to, shifting the entries in between.
+func (ic *Icon) Move(from, to int) {
+	e := ic.Entries[from]
+	if from < to {
+		copy(ic.Entries[from:to], ic.Entries[from+1:to+1])
+	} else {
+		copy(ic.Entries[to+1:from+1], ic.Entries[to:from])
+	}
+	ic.Entries[to] = e
+}
+
+// Info describes entry i from its directory fields and payload header.
+func (ic *Icon) Info(i int) (EntryInfo, error) {
+	d := ic.decoder()
+	e, err := ic.direntry(i)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	info, err := d.entryInfo(&e, ic.Entries[i].Data)
+	if err != nil {
+		return EntryInfo{}, d.entryError(i, err)
+	}
+	return info, nil
+}
+
+// Image decodes entry i within the default Decoder limits.
+func (ic *Icon) Image(i int) (image.Image, error) {
+	info, err := ic.Info(i)
+	if err != nil {
+		return nil, err
+	}
+	d := ic.decoder()
+	if err := d.checkPixels([]EntryInfo{info}); err != nil {
+		return nil, err
+	}
+	e, err := ic.direntry(i)
+	if err != nil {
+		return nil, err
+	}
+	img, err := d.decodePayload(&e, ic.Entries[i].Data)
+	if err != nil {
+		return nil, d.entryError(i, err)
+	}
+	return img, nil
+}
+
+// Encode writes ic to w. An Icon that was parsed and not modified is written
+// as the original bytes; otherwise the payloads are laid out after the
+// directory in entry order.
+func (ic *Icon) Encode(w io.Writer) error {
+	if ic.untouched() {
+		_, err := w.Write(ic.raw)
+		return err
+	}
+	entries := make([]direntry, len(ic.Entries))
+	payloads := make([][]byte, len(ic.Entries))
+	for i := range ic.Entries {
+		e, err := ic.direntry(i)
+		if err != nil {
+			return err
+		}
+		entries[i] = e
+		payloads[i] = ic.Entries[i].Data
+	}
+	return writeFile(w, ic.typ(), entries, payloads)
+}
+
+func (ic *Icon) typ() uint16 {
+	if ic.Cursor {
+		return typeCursor
+	}
+	return typeIcon
+}
+
+func (ic *Icon) decoder() *decoder {
+	return &decoder{head: head{Type: ic.typ(), Number: uint16(len(ic.Entries))}}
+}
+
+// direntry returns the directory entry of entry i, Offset left at zero.
+func (ic *Icon) direntry(i int) (direntry, error) {
+	e := &ic.Entries[i]
+	if e.Width < 1 || e.Height < 1 || e.Width > math.MaxInt32 || e.Height > math.MaxInt32 {
+		return direntry{}, fmt.Errorf("ico: entry %d: invalid size %dx%d", i, e.Width, e.Height)
+	}
+	if (e.Width > 256 || e.Height > 256) && !isPNG(e.Data) {
+		return direntry{}, ErrImageTooLarge
+	}
+	if e.Colors < 0 || e.Colors > 0xFF || e.Planes < 0 || e.Planes > 0xFFFF || e.Bits < 0 || e.Bits > 0xFFFF {
+		return direntry{}, fmt.Errorf("ico: entry %d: directory field out of range", i)
+	}
+	return direntry{
+		Width:   dirSize(e.Width),
+		Height:  dirSize(e.Height),
+		Palette: uint8(e.Colors),
+		Plane:   uint16(e.Planes),
+		Bits:    uint16(e.Bits),
+		Size:    uint32(len(e.Data)),
+	}, nil
+}
+
+// untouched reports whether ic still holds exactly what ParseIcon read.
+func (ic *Icon) untouched() bool {
+	if ic.raw == nil || ic.Cursor != ic.parsedCursor || len(ic.Entries) != len(ic.parsed) {
+		return false
+	}
+	for i := range ic.Entries {
+		a, b := &ic.Entries[i], &ic.parsed[i]
+		if a.Width != b.Width || a.Height != b.Height || a.Colors != b.Colors ||
+			a.Planes != b.Planes || a.Bits != b.Bits || !bytes.Equal(a.Data, b.Data) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,230 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"os"
+	"testing"
+)
+
+// TestIconRoundTrip tests that untouched icons are written back byte for byte
+func TestIconRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	files := []string{
+		"testdata/multi_sizes.ico",
+		"testdata/bmp_format.ico",
+		"testdata/4bit.ico",
+		"testdata/golang.ico",
+	}
+
+	for _, file := range files {
+		file := file
+		t.Run(file, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", file, err)
+			}
+			ic, err := ParseIcon(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+
+			var buf bytes.Buffer
+			if err := ic.Encode(&buf); err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Error("untouched icon not written back byte for byte")
+			}
+		})
+	}
+}
+
+// TestIconRoundTripGap tests that padding between payloads survives an
+// untouched round trip and is dropped once the icon is edited
+func TestIconRoundTripGap(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, []image.Image{createMaskedImage(16), createMaskedImage(32)}); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	orig := buf.Bytes()
+
+	// Insert 4 bytes of padding before the first payload.
+	data := append([]byte(nil), orig[:headSize+2*direntrySize]...)
+	data = append(data, 0xAA, 0xBB, 0xCC, 0xDD)
+	data = append(data, orig[headSize+2*direntrySize:]...)
+	for i := 0; i < 2; i++ {
+		off := headSize + i*direntrySize + 12
+		binary.LittleEndian.PutUint32(data[off:], binary.LittleEndian.Uint32(data[off:])+4)
+	}
+
+	ic, err := ParseIcon(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	var out bytes.Buffer
+	if err := ic.Encode(&out); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("padding lost in untouched round trip")
+	}
+
+	ic.Move(1, 0)
+	ic.Move(0, 1)
+	out.Reset()
+	if err := ic.Encode(&out); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("reverted edit not detected as untouched")
+	}
+
+	ic.Move(1, 0)
+	out.Reset()
+	if err := ic.Encode(&out); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	infos, err := ReadDirectory(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	if len(infos) != 2 || infos[0].ImageWidth != 32 || infos[1].ImageWidth != 16 {
+		t.Fatalf("expected entries 32, 16, got %+v", infos)
+	}
+	if infos[0].Offset != headSize+2*direntrySize {
+		t.Errorf("expected payloads laid out after directory, got offset %d", infos[0].Offset)
+	}
+}
+
+// TestIconEdit tests adding, removing and replacing entries
+func TestIconEdit(t *testing.T) {
+	t.Parallel()
+
+	data, err := os.ReadFile("testdata/multi_sizes.ico")
+	if err != nil {
+		t.Fatalf("failed to read multi_sizes.ico: %v", err)
+	}
+	ic, err := ParseIcon(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	n := len(ic.Entries)
+	untouched := ic.Entries[n-1]
+
+	enc := Encoder{Format: FormatBMP}
+	e24, err := enc.NewEntry(EntryImage{Image: createMaskedImage(24)})
+	if err != nil {
+		t.Fatalf("failed to create entry: %v", err)
+	}
+	e20, err := enc.NewEntry(EntryImage{Image: createMaskedImage(20), Bits: 8})
+	if err != nil {
+		t.Fatalf("failed to create entry: %v", err)
+	}
+	ic.Add(e24)
+	ic.Replace(0, e20)
+	ic.Remove(1)
+
+	var buf bytes.Buffer
+	if err := ic.Encode(&buf); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	imgs, err := DecodeAll(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to decode edited icon: %v", err)
+	}
+	if len(imgs) != n {
+		t.Fatalf("expected %d images, got %d", n, len(imgs))
+	}
+	if w := imgs[0].Bounds().Dx(); w != 20 {
+		t.Errorf("expected replaced entry of width 20, got %d", w)
+	}
+	if w := imgs[n-1].Bounds().Dx(); w != 24 {
+		t.Errorf("expected added entry of width 24, got %d", w)
+	}
+
+	edited, err := ParseIcon(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to parse edited icon: %v", err)
+	}
+	if got := edited.Entries[n-2]; !bytes.Equal(got.Data, untouched.Data) || got.Width != untouched.Width {
+		t.Error("untouched entry changed by edit")
+	}
+	info, err := edited.Info(0)
+	if err != nil {
+		t.Fatalf("failed to read info: %v", err)
+	}
+	if info.Format != FormatBMP || info.ImageBits != 8 {
+		t.Errorf("expected 8-bit BMP entry, got %+v", info)
+	}
+	img, err := edited.Image(n - 1)
+	if err != nil {
+		t.Fatalf("failed to decode entry: %v", err)
+	}
+	if img.Bounds().Dx() != 24 {
+		t.Errorf("expected 24x24 image, got %v", img.Bounds())
+	}
+
+	edited.Entries = nil
+	if err := edited.Encode(&buf); err != ErrNoImages {
+		t.Errorf("expected ErrNoImages, got %v", err)
+	}
+}
+
+// TestIconBadData tests that Info and Image report truncated or corrupt
+// payloads as FormatErrors tied to the entry
+func TestIconBadData(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		file    string
+		corrupt func([]byte) []byte
+	}{
+		{"truncated BMP", "testdata/bmp_format.ico", func(b []byte) []byte { return b[:10] }},
+		{"truncated PNG", "testdata/golang.ico", func(b []byte) []byte { return b[:10] }},
+		{"corrupt header", "testdata/bmp_format.ico", func(b []byte) []byte {
+			copy(b, []byte{0xFF, 0xFF, 0xFF, 0xFF})
+			return b
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := os.ReadFile(tt.file)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", tt.file, err)
+			}
+			ic, err := ParseIcon(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			last := len(ic.Entries) - 1
+			ic.Entries[last].Data = tt.corrupt(ic.Entries[last].Data)
+
+			check := func(op string, err error) {
+				var fe *FormatError
+				if !errors.As(err, &fe) {
+					t.Fatalf("%s: expected *FormatError, got %v", op, err)
+				}
+				if fe.Entry != last || fe.Offset != -1 {
+					t.Errorf("%s: expected entry %d at offset -1, got entry %d at offset %d", op, last, fe.Entry, fe.Offset)
+				}
+			}
+			_, err = ic.Info(last)
+			check("Info", err)
+			_, err = ic.Image(last)
+			check("Image", err)
+		})
+	}
+}
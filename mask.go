@@ -0,0 +1,87 @@
+package ico
+
+import (
+	"image"
+	"io"
+)
+
+// A MaskedImage is an entry split into the two bitmaps Windows combines
+// with the screen, each pixel becoming (screen AND mask) XOR colour. Where
+// the mask bit is clear the colour replaces the screen. Where it is set, a
+// black colour leaves the screen unchanged and any other colour is XORed
+// into it, white inverting it. Decode turns every masked pixel transparent,
+// which loses the inverting ones common in monochrome cursors.
+type MaskedImage struct {
+	// XOR is the colour bitmap. Masked pixels keep their stored colour.
+	// It is opaque unless the entry has an alpha channel, which PNG
+	// entries and some 16 and 32-bit DIB entries do.
+	XOR image.Image
+	// AND is the AND mask, 0xff where a bit is set. It is nil for PNG
+	// entries and DIB entries stored without a mask.
+	AND *image.Gray
+	// Invert is 0xff where a set mask bit meets a non-black colour, so
+	// that the screen is XORed rather than left unchanged. It is nil if
+	// AND is nil or the entry's alpha channel overrides the mask.
+	Invert *image.Alpha
+}
+
+// DecodeAllMasked is like DecodeAll but returns the XOR bitmap and AND mask
+// of every entry separately instead of compositing them.
+func DecodeAllMasked(r io.Reader) ([]MaskedImage, error) {
+	var dec Decoder
+	return dec.DecodeAllMasked(r)
+}
+
+// DecodeAllMasked is like the package-level DecodeAllMasked but applies
+// dec's limits.
+func (dec *Decoder) DecodeAllMasked(r io.Reader) ([]MaskedImage, error) {
+	d := decoder{limits: *dec}
+	file, err := d.decodeDirectory(r)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := d.entryInfos(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkPixels(infos); err != nil {
+		return nil, err
+	}
+
+	ms := make([]MaskedImage, len(d.entries))
+	for i := range d.entries {
+		if ms[i], err = d.decodeMasked(file, i); err != nil {
+			return nil, d.entryError(i, err)
+		}
+	}
+	return ms, nil
+}
+
+// decodeMasked decodes entry i without compositing its mask.
+func (d *decoder) decodeMasked(file []byte, i int) (MaskedImage, error) {
+	e := &(d.entries[i])
+	entryData, err := d.entryBytes(file, e)
+	if err != nil {
+		return MaskedImage{}, err
+	}
+	if isPNG(entryData) {
+		img, err := d.decodePayload(e, entryData)
+		return MaskedImage{XOR: img}, err
+	}
+
+	pl, err := decodeDIBPlanes(entryData, e)
+	if err != nil {
+		return MaskedImage{}, err
+	}
+	m := MaskedImage{XOR: pl.xor, AND: pl.and}
+	if pl.and == nil || pl.hasAlpha {
+		return m, nil
+	}
+	m.Invert = image.NewAlpha(pl.and.Rect)
+	for j, bit := range pl.and.Pix {
+		if c := pl.xor.Pix[j*4 : j*4+3]; bit != 0 && (c[0] != 0 || c[1] != 0 || c[2] != 0) {
+			m.Invert.Pix[j] = 0xff
+		}
+	}
+	return m, nil
+}
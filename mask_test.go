@@ -0,0 +1,87 @@
+package ico
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestDecodeAllMasked tests that the XOR bitmap, AND mask and invert overlay
+// of a monochrome entry are returned separately
+func TestDecodeAllMasked(t *testing.T) {
+	t.Parallel()
+
+	// Top row: white and black under a set mask bit; bottom row: white and
+	// black drawn as is. Rows are stored bottom-up.
+	table := []byte{0, 0, 0, 0, 0xff, 0xff, 0xff, 0}
+	payload := buildDIB(40, 2, 2, 1, false, table, nil, [][]byte{{0x80}, {0x80}}, [][]byte{{0x00}, {0xc0}})
+	data := wrapICO(2, 2, payload)
+
+	ms, err := DecodeAllMasked(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if len(ms) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(ms))
+	}
+	m := ms[0]
+
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	black := color.NRGBA{0, 0, 0, 0xff}
+	xor := m.XOR.(*image.NRGBA)
+	wantXOR := [4]color.NRGBA{white, black, white, black}
+	gotXOR := [4]color.NRGBA{xor.NRGBAAt(0, 0), xor.NRGBAAt(1, 0), xor.NRGBAAt(0, 1), xor.NRGBAAt(1, 1)}
+	if gotXOR != wantXOR {
+		t.Errorf("XOR: expected %v, got %v", wantXOR, gotXOR)
+	}
+	if m.AND == nil || !bytes.Equal(m.AND.Pix, []byte{0xff, 0xff, 0, 0}) {
+		t.Errorf("AND: expected [255 255 0 0], got %v", m.AND)
+	}
+	if m.Invert == nil || !bytes.Equal(m.Invert.Pix, []byte{0xff, 0, 0, 0}) {
+		t.Errorf("Invert: expected [255 0 0 0], got %v", m.Invert)
+	}
+
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	nrgba := img.(*image.NRGBA)
+	if got := nrgba.NRGBAAt(0, 0); got != (color.NRGBA{}) {
+		t.Errorf("Decode: expected inverting pixel transparent, got %v", got)
+	}
+	if got := nrgba.NRGBAAt(0, 1); got != white {
+		t.Errorf("Decode: expected white, got %v", got)
+	}
+}
+
+// TestDecodeAllMaskedAlpha tests entries whose transparency is not a mask
+func TestDecodeAllMaskedAlpha(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	var enc Encoder
+	err := enc.EncodeEntries(&buf, []EntryImage{
+		{Image: createMaskedImage(16), Format: FormatBMP},
+		{Image: createMaskedImage(16), Format: FormatPNG},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+
+	ms, err := DecodeAllMasked(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if ms[0].AND == nil || ms[0].AND.GrayAt(0, 0).Y != 0xff || ms[0].Invert != nil {
+		t.Errorf("32-bit: expected AND mask without invert overlay")
+	}
+	if ms[1].AND != nil || ms[1].Invert != nil {
+		t.Errorf("PNG: expected no AND mask")
+	}
+	for i, m := range ms {
+		if _, _, _, a := m.XOR.At(0, 0).RGBA(); a != 0 {
+			t.Errorf("entry %d: expected transparent corner, got alpha %d", i, a)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package ico
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf16"
+)
+
+const (
+	rtIcon      = 3  // resource type of icon images
+	rtGroupIcon = 14 // resource type of icon directories
+
+	resDirSize          = 16 // binary size of IMAGE_RESOURCE_DIRECTORY
+	resEntrySize        = 8  // binary size of IMAGE_RESOURCE_DIRECTORY_ENTRY
+	grpIconDirEntrySize = 14 // binary size of GRPICONDIRENTRY
+
+	resHighBit = 1 << 31 // marks names and subdirectories in directory entries
+)
+
+// A PEIcon is one icon group of a Windows executable or DLL, reassembled
+// into a standalone ICO file.
+type PEIcon struct {
+	// Name is the resource name of the group, or empty if the group is
+	// identified by ID.
+	Name string
+	// ID is the resource ID of the group when Name is empty.
+	ID int
+	// Language is the language ID of the resource, such as 0x409 for US
+	// English. Only the first language of each group is extracted.
+	Language int
+	// Data is the ICO file, which Decode and the other decoders read.
+	Data []byte
+}
+
+// ExtractPEIcons returns every RT_GROUP_ICON resource of the PE executable
+// or DLL in r, in resource directory order: named groups first, then groups
+// by ascending ID. The group directory is rewritten with file offsets in
+// place of the RT_ICON IDs it refers to. Payloads are copied as they are,
+// without being decoded.
+func ExtractPEIcons(r io.ReaderAt) ([]PEIcon, error) {
+	var dec Decoder
+	return dec.ExtractPEIcons(r)
+}
+
+// ExtractPEIcons is like the package-level ExtractPEIcons but applies dec's
+// MaxFileSize to every resource read and MaxEntries to every group.
+func (dec *Decoder) ExtractPEIcons(r io.ReaderAt) ([]PEIcon, error) {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return nil, formatError(err, "invalid PE file")
+	}
+	defer f.Close()
+
+	res, err := newPEResources(f, *dec)
+	if err != nil {
+		return nil, err
+	}
+	types, err := res.entries(0)
+	if err != nil {
+		return nil, err
+	}
+
+	icons := make(map[int][]byte)
+	var groups []resEntry
+	for _, t := range types {
+		if t.name != "" || !t.dir {
+			continue
+		}
+		switch t.id {
+		case rtIcon:
+			entries, err := res.entries(t.offset)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if e.name != "" {
+					continue
+				}
+				if _, icons[e.id], err = res.leaf(e); err != nil {
+					return nil, err
+				}
+			}
+		case rtGroupIcon:
+			if groups, err = res.entries(t.offset); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return nil, ErrNoImages
+	}
+
+	out := make([]PEIcon, len(groups))
+	for i, g := range groups {
+		lang, dir, err := res.leaf(g)
+		if err != nil {
+			return nil, err
+		}
+		data, err := res.limits.assembleGroup(dir, icons)
+		if err != nil {
+			var fe *FormatError
+			if errors.As(err, &fe) {
+				fe.Reason = fmt.Sprintf("icon group %s: %s", g.label(), fe.Reason)
+			}
+			return nil, err
+		}
+		out[i] = PEIcon{Name: g.name, ID: g.id, Language: lang, Data: data}
+	}
+	return out, nil
+}
+
+// assembleGroup turns the GRPICONDIR resource dir into an ICO file holding
+// the RT_ICON resources it lists.
+func (dec *Decoder) assembleGroup(dir []byte, icons map[int][]byte) ([]byte, error) {
+	if len(dir) < headSize {
+		return nil, truncated("icon group header")
+	}
+	h := head{
+		Zero:   binary.LittleEndian.Uint16(dir),
+		Type:   binary.LittleEndian.Uint16(dir[2:]),
+		Number: binary.LittleEndian.Uint16(dir[4:]),
+	}
+	if h.Zero != 0 || h.Type != typeIcon {
+		return nil, formatError(nil, "corrupted head: [%x,%x]", h.Zero, h.Type)
+	}
+	n := int(h.Number)
+	if max := limit(int64(dec.MaxEntries), DefaultMaxEntries); int64(n) > max {
+		return nil, limitError("too many entries (%d > %d)", n, max)
+	}
+	if len(dir) < headSize+n*grpIconDirEntrySize {
+		return nil, truncated("icon group directory")
+	}
+
+	entries := make([]direntry, n)
+	payloads := make([][]byte, n)
+	for i := range entries {
+		b := dir[headSize+i*grpIconDirEntrySize:]
+		id := int(binary.LittleEndian.Uint16(b[12:]))
+		payload, ok := icons[id]
+		if !ok {
+			fe := formatError(nil, "missing RT_ICON resource %d", id)
+			fe.Entry = i
+			return nil, fe
+		}
+		entries[i] = direntry{
+			Width:   b[0],
+			Height:  b[1],
+			Palette: b[2],
+			Plane:   binary.LittleEndian.Uint16(b[4:]),
+			Bits:    binary.LittleEndian.Uint16(b[6:]),
+			Size:    uint32(len(payload)),
+		}
+		payloads[i] = payload
+	}
+
+	var buf bytes.Buffer
+	if err := writeFile(&buf, typeIcon, entries, payloads); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// peResources reads the resource directory tree of a PE file.
+type peResources struct {
+	f      *pe.File
+	limits Decoder
+	// data holds the section containing the resource directory, from the
+	// start of the directory on, and fileOffset its position in the file.
+	data       []byte
+	fileOffset int64
+}
+
+// A resEntry is a parsed IMAGE_RESOURCE_DIRECTORY_ENTRY.
+type resEntry struct {
+	name string
+	id   int
+	// offset locates the subdirectory, or the data entry if dir is false,
+	// relative to the start of the resource directory.
+	offset uint32
+	dir    bool
+}
+
+// label names e in error messages.
+func (e *resEntry) label() string {
+	if e.name != "" {
+		return fmt.Sprintf("%q", e.name)
+	}
+	return fmt.Sprintf("#%d", e.id)
+}
+
+func newPEResources(f *pe.File, limits Decoder) (*peResources, error) {
+	var dd pe.DataDirectory
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		if oh.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_RESOURCE {
+			dd = oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_RESOURCE]
+		}
+	case *pe.OptionalHeader64:
+		if oh.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_RESOURCE {
+			dd = oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_RESOURCE]
+		}
+	}
+	if dd.VirtualAddress == 0 {
+		return nil, ErrNoImages
+	}
+
+	s := sectionAt(f, dd.VirtualAddress)
+	if s == nil {
+		return nil, formatError(nil, "resource directory RVA %#x outside every section", dd.VirtualAddress)
+	}
+	start := dd.VirtualAddress - s.VirtualAddress
+	if start >= s.Size {
+		return nil, truncated("resource section")
+	}
+	if max := limit(limits.MaxFileSize, DefaultMaxFileSize); int64(s.Size) > max {
+		return nil, limitError("resource section too large (%d bytes, limit %d)", s.Size, max)
+	}
+	data, err := s.Data()
+	if err != nil {
+		return nil, formatError(err, "unreadable resource section")
+	}
+	return &peResources{
+		f:          f,
+		limits:     limits,
+		data:       data[start:],
+		fileOffset: int64(s.Offset) + int64(start),
+	}, nil
+}
+
+// sectionAt returns the section mapping rva, or nil.
+func sectionAt(f *pe.File, rva uint32) *pe.Section {
+	for _, s := range f.Sections {
+		size := max(s.VirtualSize, s.Size)
+		if rva >= s.VirtualAddress && rva-s.VirtualAddress < size {
+			return s
+		}
+	}
+	return nil
+}
+
+// errorf returns a FormatError located at off within the resource directory.
+func (res *peResources) errorf(off uint32, err error, format string, args ...interface{}) *FormatError {
+	fe := formatError(err, format, args...)
+	fe.Offset = res.fileOffset + int64(off)
+	return fe
+}
+
+// entries returns the entries of the directory at off.
+func (res *peResources) entries(off uint32) ([]resEntry, error) {
+	if int64(off)+resDirSize > int64(len(res.data)) {
+		return nil, res.errorf(off, io.ErrUnexpectedEOF, "truncated resource directory")
+	}
+	d := res.data[off:]
+	n := int(binary.LittleEndian.Uint16(d[12:])) + int(binary.LittleEndian.Uint16(d[14:]))
+	if resDirSize+n*resEntrySize > len(d) {
+		return nil, res.errorf(off, io.ErrUnexpectedEOF, "truncated resource directory of %d entries", n)
+	}
+
+	entries := make([]resEntry, n)
+	for i := range entries {
+		b := d[resDirSize+i*resEntrySize:]
+		name, target := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		e := resEntry{offset: target &^ resHighBit, dir: target&resHighBit != 0}
+		if name&resHighBit != 0 {
+			var err error
+			if e.name, err = res.string(name &^ resHighBit); err != nil {
+				return nil, err
+			}
+		} else {
+			e.id = int(name)
+		}
+		entries[i] = e
+	}
+	return entries, nil
+}
+
+// string returns the length-prefixed UTF-16 resource name at off.
+func (res *peResources) string(off uint32) (string, error) {
+	if int64(off)+2 > int64(len(res.data)) {
+		return "", res.errorf(off, io.ErrUnexpectedEOF, "truncated resource name")
+	}
+	n := int(binary.LittleEndian.Uint16(res.data[off:]))
+	b := res.data[off+2:]
+	if 2*n > len(b) {
+		return "", res.errorf(off, io.ErrUnexpectedEOF, "truncated resource name")
+	}
+	u := make([]uint16, n)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u)), nil
+}
+
+// leaf returns the language and data of the first language of the named
+// resource e.
+func (res *peResources) leaf(e resEntry) (lang int, data []byte, err error) {
+	if !e.dir {
+		return 0, nil, res.errorf(e.offset, nil, "resource %s has no language directory", e.label())
+	}
+	langs, err := res.entries(e.offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(langs) == 0 || langs[0].dir {
+		return 0, nil, res.errorf(e.offset, nil, "resource %s has no data", e.label())
+	}
+
+	off := langs[0].offset
+	if int64(off)+16 > int64(len(res.data)) {
+		return 0, nil, res.errorf(off, io.ErrUnexpectedEOF, "truncated resource data entry")
+	}
+	rva := binary.LittleEndian.Uint32(res.data[off:])
+	size := binary.LittleEndian.Uint32(res.data[off+4:])
+	if max := limit(res.limits.MaxFileSize, DefaultMaxFileSize); int64(size) > max {
+		return 0, nil, limitError("resource too large (%d bytes, limit %d)", size, max)
+	}
+
+	s := sectionAt(res.f, rva)
+	if s == nil {
+		return 0, nil, res.errorf(off, nil, "resource %s data RVA %#x outside every section", e.label(), rva)
+	}
+	data = make([]byte, size)
+	if _, err := s.ReadAt(data, int64(rva-s.VirtualAddress)); err != nil {
+		return 0, nil, res.errorf(off, io.ErrUnexpectedEOF, "resource %s data past end of section", e.label())
+	}
+	return langs[0].id, data, nil
+}
@@ -0,0 +1,256 @@
+package ico
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"image"
+	"sort"
+	"testing"
+	"unicode/utf16"
+)
+
+// testResource is one resource of buildPE, with a single language 0x409
+type testResource struct {
+	name string
+	id   int
+	data []byte
+}
+
+// buildRSRC lays out a resource section mapped at rva
+func buildRSRC(rva uint32, types map[int][]testResource) []byte {
+	ids := make([]int, 0, len(types))
+	for id := range types {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	// Directories first, then names, data entries and data.
+	dirSize := func(n int) int { return resDirSize + n*resEntrySize }
+	off := dirSize(len(ids))
+	typeDirs := make([]int, len(ids))
+	var all []testResource
+	for i, id := range ids {
+		typeDirs[i] = off
+		off += dirSize(len(types[id]))
+		all = append(all, types[id]...)
+	}
+	langDirs := make([]int, len(all))
+	for i := range all {
+		langDirs[i] = off
+		off += dirSize(1)
+	}
+	names := make([]int, len(all))
+	for i, r := range all {
+		names[i] = off
+		off += 2 + 2*len(utf16.Encode([]rune(r.name)))
+	}
+	off = (off + 3) &^ 3
+	dataEntries := make([]int, len(all))
+	for i := range all {
+		dataEntries[i] = off
+		off += 16
+	}
+	dataOffs := make([]int, len(all))
+	for i, r := range all {
+		dataOffs[i] = off
+		off += len(r.data)
+	}
+
+	b := make([]byte, off)
+	putDir := func(at int, entries [][2]uint32) {
+		binary.LittleEndian.PutUint16(b[at+14:], uint16(len(entries)))
+		for i, e := range entries {
+			binary.LittleEndian.PutUint32(b[at+resDirSize+i*resEntrySize:], e[0])
+			binary.LittleEndian.PutUint32(b[at+resDirSize+i*resEntrySize+4:], e[1])
+		}
+	}
+	var root [][2]uint32
+	k := 0
+	for i, id := range ids {
+		root = append(root, [2]uint32{uint32(id), uint32(typeDirs[i]) | resHighBit})
+		var entries [][2]uint32
+		for _, r := range types[id] {
+			name := uint32(r.id)
+			if r.name != "" {
+				name = uint32(names[k]) | resHighBit
+				u := utf16.Encode([]rune(r.name))
+				binary.LittleEndian.PutUint16(b[names[k]:], uint16(len(u)))
+				for j, c := range u {
+					binary.LittleEndian.PutUint16(b[names[k]+2+2*j:], c)
+				}
+			}
+			entries = append(entries, [2]uint32{name, uint32(langDirs[k]) | resHighBit})
+			putDir(langDirs[k], [][2]uint32{{0x409, uint32(dataEntries[k])}})
+			binary.LittleEndian.PutUint32(b[dataEntries[k]:], rva+uint32(dataOffs[k]))
+			binary.LittleEndian.PutUint32(b[dataEntries[k]+4:], uint32(len(r.data)))
+			copy(b[dataOffs[k]:], r.data)
+			k++
+		}
+		putDir(typeDirs[i], entries)
+	}
+	putDir(0, root)
+	return b
+}
+
+// buildPE returns a minimal PE32 file whose only section holds rsrc
+func buildPE(t *testing.T, rsrc []byte) []byte {
+	t.Helper()
+
+	const (
+		lfanew  = 64
+		rawData = 0x200
+		rva     = 0x1000
+	)
+	var buf bytes.Buffer
+	dos := make([]byte, lfanew)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], lfanew)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+
+	oh := pe.OptionalHeader32{
+		Magic:               0x10b,
+		SectionAlignment:    0x1000,
+		FileAlignment:       0x200,
+		SizeOfImage:         rva + uint32(len(rsrc)),
+		SizeOfHeaders:       rawData,
+		NumberOfRvaAndSizes: 16,
+	}
+	oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_RESOURCE] = pe.DataDirectory{VirtualAddress: rva, Size: uint32(len(rsrc))}
+	sh := pe.SectionHeader32{
+		VirtualSize:      uint32(len(rsrc)),
+		VirtualAddress:   rva,
+		SizeOfRawData:    uint32(len(rsrc)),
+		PointerToRawData: rawData,
+	}
+	copy(sh.Name[:], ".rsrc")
+	for _, v := range []interface{}{
+		pe.FileHeader{Machine: pe.IMAGE_FILE_MACHINE_I386, NumberOfSections: 1, SizeOfOptionalHeader: uint16(binary.Size(oh)), Characteristics: 0x102},
+		oh,
+		sh,
+	} {
+		if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+			t.Fatalf("failed to write PE headers: %v", err)
+		}
+	}
+	buf.Write(make([]byte, rawData-buf.Len()))
+	buf.Write(rsrc)
+	return buf.Bytes()
+}
+
+// grpIconDir builds a GRPICONDIR from an ICO file, numbering its images
+// from firstID
+func grpIconDir(t *testing.T, ico []byte, firstID int) (dir []byte, icons []testResource) {
+	t.Helper()
+
+	var d decoder
+	file, err := d.decodeDirectory(bytes.NewReader(ico))
+	if err != nil {
+		t.Fatalf("failed to parse test icon: %v", err)
+	}
+	dir = append(dir, file[:headSize]...)
+	for i := range d.entries {
+		e := &d.entries[i]
+		payload, err := d.entryBytes(file, e)
+		if err != nil {
+			t.Fatalf("failed to read test entry: %v", err)
+		}
+		dir = append(dir, e.Width, e.Height, e.Palette, 0)
+		dir = binary.LittleEndian.AppendUint16(dir, e.Plane)
+		dir = binary.LittleEndian.AppendUint16(dir, e.Bits)
+		dir = binary.LittleEndian.AppendUint32(dir, e.Size)
+		dir = binary.LittleEndian.AppendUint16(dir, uint16(firstID+i))
+		icons = append(icons, testResource{id: firstID + i, data: payload})
+	}
+	return dir, icons
+}
+
+// TestExtractPEIcons tests reassembling named and numbered icon groups
+func TestExtractPEIcons(t *testing.T) {
+	t.Parallel()
+
+	var app, doc bytes.Buffer
+	if err := EncodeSizes(&app, createMaskedImage(64), []int{16, 32}); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	enc := Encoder{Format: FormatPNG}
+	if err := enc.Encode(&doc, createMaskedImage(48)); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	appDir, appIcons := grpIconDir(t, app.Bytes(), 1)
+	docDir, docIcons := grpIconDir(t, doc.Bytes(), 7)
+
+	file := buildPE(t, buildRSRC(0x1000, map[int][]testResource{
+		rtIcon:      append(appIcons, docIcons...),
+		rtGroupIcon: {{name: "MAINICON", data: appDir}, {id: 101, data: docDir}},
+		16:          {{id: 1, data: []byte("version info")}},
+	}))
+
+	icons, err := ExtractPEIcons(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("failed to extract: %v", err)
+	}
+	if len(icons) != 2 {
+		t.Fatalf("expected 2 groups, got %d", len(icons))
+	}
+	if icons[0].Name != "MAINICON" || icons[1].Name != "" || icons[1].ID != 101 || icons[0].Language != 0x409 {
+		t.Errorf("unexpected groups: %q/%d, %q/%d lang %#x", icons[0].Name, icons[0].ID, icons[1].Name, icons[1].ID, icons[0].Language)
+	}
+	if !bytes.Equal(icons[0].Data, app.Bytes()) || !bytes.Equal(icons[1].Data, doc.Bytes()) {
+		t.Error("extracted icons differ from the originals")
+	}
+	imgs, err := DecodeAll(bytes.NewReader(icons[0].Data))
+	if err != nil || len(imgs) != 2 || imgs[1].Bounds() != image.Rect(0, 0, 32, 32) {
+		t.Errorf("failed to decode extracted icon: %v", err)
+	}
+}
+
+// TestExtractPEIconsErrors tests executables without usable icons
+func TestExtractPEIconsErrors(t *testing.T) {
+	t.Parallel()
+
+	var ico bytes.Buffer
+	if err := EncodeAll(&ico, []image.Image{createMaskedImage(16), createMaskedImage(32)}); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	dir, icons := grpIconDir(t, ico.Bytes(), 1)
+
+	tests := []struct {
+		name string
+		data []byte
+		dec  Decoder
+		want error
+	}{
+		{"not a PE", ico.Bytes(), Decoder{}, ErrFormat},
+		{"no icons", buildPE(t, buildRSRC(0x1000, map[int][]testResource{16: {{id: 1, data: []byte("x")}}})), Decoder{}, ErrNoImages},
+		{"missing icon", buildPE(t, buildRSRC(0x1000, map[int][]testResource{
+			rtIcon:      icons[:1],
+			rtGroupIcon: {{id: 1, data: dir}},
+		})), Decoder{}, ErrFormat},
+		{"truncated group", buildPE(t, buildRSRC(0x1000, map[int][]testResource{
+			rtIcon:      icons,
+			rtGroupIcon: {{id: 1, data: dir[:headSize+grpIconDirEntrySize]}},
+		})), Decoder{}, ErrFormat},
+		{"too many entries", buildPE(t, buildRSRC(0x1000, map[int][]testResource{
+			rtIcon:      icons,
+			rtGroupIcon: {{id: 1, data: dir}},
+		})), Decoder{MaxEntries: 1}, ErrLimitExceeded},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := tc.dec.ExtractPEIcons(bytes.NewReader(tc.data)); !errors.Is(err, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+
+	var fe *FormatError
+	_, err := ExtractPEIcons(bytes.NewReader(tests[2].data))
+	if !errors.As(err, &fe) || fe.Entry != 1 {
+		t.Errorf("expected error at entry 1, got %v", err)
+	}
+}
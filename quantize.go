@@ -0,0 +1,226 @@
+package ico
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// alphaThreshold is the alpha below which a pixel is treated as transparent
+// when an entry cannot store an alpha channel.
+const alphaThreshold = 0x80
+
+// quantize returns a palette of at most n colours approximating the opaque
+// pixels of im, using median cut. Images that already use n or fewer
+// colours get exactly those colours.
+func quantize(im image.Image, n int) color.Palette {
+	hist := make(map[color.NRGBA]int)
+	b := im.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(im.At(x, y)).(color.NRGBA)
+			if c.A < alphaThreshold {
+				continue
+			}
+			c.A = 0xff
+			hist[c]++
+		}
+	}
+
+	colors := make([]histEntry, 0, len(hist))
+	for c, count := range hist {
+		colors = append(colors, histEntry{c, count})
+	}
+	sort.Slice(colors, func(i, j int) bool {
+		return colorKey(colors[i].c) < colorKey(colors[j].c)
+	})
+
+	if len(colors) <= n {
+		pal := make(color.Palette, len(colors))
+		for i, e := range colors {
+			pal[i] = e.c
+		}
+		return pal
+	}
+
+	boxes := []colorBox{{colors}}
+	for len(boxes) < n {
+		i := splittableBox(boxes)
+		if i < 0 {
+			break
+		}
+		lo, hi := boxes[i].split()
+		boxes[i] = lo
+		boxes = append(boxes, hi)
+	}
+
+	pal := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		pal[i] = box.average()
+	}
+	return pal
+}
+
+type histEntry struct {
+	c     color.NRGBA
+	count int
+}
+
+func colorKey(c color.NRGBA) uint32 {
+	return uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+}
+
+// colorBox is a set of histogram colours split as one unit by median cut.
+type colorBox struct {
+	colors []histEntry
+}
+
+// splittableBox returns the index of the box to split next, the one with
+// the widest channel range weighted by population, or -1 if no box holds
+// more than one colour.
+func splittableBox(boxes []colorBox) int {
+	best, bestScore := -1, 0
+	for i, box := range boxes {
+		if len(box.colors) < 2 {
+			continue
+		}
+		_, span := box.widestChannel()
+		score := span * box.population()
+		if best < 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+func (box colorBox) population() int {
+	n := 0
+	for _, e := range box.colors {
+		n += e.count
+	}
+	return n
+}
+
+// widestChannel returns the channel (0=R, 1=G, 2=B) with the largest range
+// of values in the box, and that range.
+func (box colorBox) widestChannel() (int, int) {
+	var lo, hi [3]int
+	for i := range lo {
+		lo[i] = 0xff
+	}
+	for _, e := range box.colors {
+		v := [3]int{int(e.c.R), int(e.c.G), int(e.c.B)}
+		for i := range v {
+			if v[i] < lo[i] {
+				lo[i] = v[i]
+			}
+			if v[i] > hi[i] {
+				hi[i] = v[i]
+			}
+		}
+	}
+	ch := 0
+	for i := 1; i < 3; i++ {
+		if hi[i]-lo[i] > hi[ch]-lo[ch] {
+			ch = i
+		}
+	}
+	return ch, hi[ch] - lo[ch]
+}
+
+// split divides the box at the population median of its widest channel.
+func (box colorBox) split() (colorBox, colorBox) {
+	ch, _ := box.widestChannel()
+	channel := func(c color.NRGBA) uint8 {
+		switch ch {
+		case 0:
+			return c.R
+		case 1:
+			return c.G
+		}
+		return c.B
+	}
+	sort.SliceStable(box.colors, func(i, j int) bool {
+		return channel(box.colors[i].c) < channel(box.colors[j].c)
+	})
+
+	half := box.population() / 2
+	n, at := 0, 1
+	for i, e := range box.colors[:len(box.colors)-1] {
+		n += e.count
+		at = i + 1
+		if n >= half {
+			break
+		}
+	}
+	return colorBox{box.colors[:at]}, colorBox{box.colors[at:]}
+}
+
+// average returns the population-weighted mean colour of the box.
+func (box colorBox) average() color.NRGBA {
+	var r, g, b, n int
+	for _, e := range box.colors {
+		r += int(e.c.R) * e.count
+		g += int(e.c.G) * e.count
+		b += int(e.c.B) * e.count
+		n += e.count
+	}
+	return color.NRGBA{
+		R: uint8((r + n/2) / n),
+		G: uint8((g + n/2) / n),
+		B: uint8((b + n/2) / n),
+		A: 0xff,
+	}
+}
+
+// hasTransparency reports whether any pixel of im falls below alphaThreshold.
+func hasTransparency(im image.Image) bool {
+	b := im.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := im.At(x, y).RGBA(); a>>8 < alphaThreshold {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// indexedPalette builds the palette for a paletted entry of the given bit
+// depth. When im has transparent pixels, reserved, the colour stored under
+// them, is kept in the palette, taking a slot of its own only if
+// quantising to the full depth does not already produce it.
+func indexedPalette(im image.Image, bits int, reserved color.Color) color.Palette {
+	n := 1 << uint(bits)
+	pal := quantize(im, n)
+	if !hasTransparency(im) {
+		return pal
+	}
+	for _, c := range pal {
+		if c == reserved {
+			return pal
+		}
+	}
+	return append(quantize(im, n-1), reserved)
+}
+
+// paletteIndexer maps colours to their nearest palette index, caching
+// results since icons tend to repeat colours.
+type paletteIndexer struct {
+	pal   color.Palette
+	cache map[color.NRGBA]uint8
+}
+
+func newPaletteIndexer(pal color.Palette) *paletteIndexer {
+	return &paletteIndexer{pal: pal, cache: make(map[color.NRGBA]uint8)}
+}
+
+func (p *paletteIndexer) index(c color.NRGBA) uint8 {
+	c.A = 0xff
+	if i, ok := p.cache[c]; ok {
+		return i
+	}
+	i := uint8(p.pal.Index(c))
+	p.cache[c] = i
+	return i
+}
@@ -0,0 +1,67 @@
+package ico
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestQuantize tests palette sizes and exactness of the median cut quantiser
+func TestQuantize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		image image.Image
+		n     int
+		want  int
+	}{
+		{"few colours kept exactly", createPalettedImage(32, 5), 16, 5},
+		{"gradient to 2", createTestImageForWrite(64), 2, 2},
+		{"gradient to 16", createTestImageForWrite(64), 16, 16},
+		{"gradient to 256", createTestImageForWrite(64), 256, 256},
+		{"fully transparent", image.NewNRGBA(image.Rect(0, 0, 8, 8)), 16, 0},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			pal := quantize(tc.image, tc.n)
+			if len(pal) != tc.want {
+				t.Fatalf("expected %d colours, got %d", tc.want, len(pal))
+			}
+			for i, c := range pal {
+				if _, _, _, a := c.RGBA(); a != 0xffff {
+					t.Errorf("colour %d is not opaque: %v", i, c)
+				}
+			}
+		})
+	}
+}
+
+// TestIndexedPalette tests that transparent images keep a slot for the reserved colour
+func TestIndexedPalette(t *testing.T) {
+	t.Parallel()
+
+	reserved := color.NRGBA{A: 0xff}
+	pal := indexedPalette(createTestImageForWrite(32), 4, reserved)
+	if len(pal) != 16 {
+		t.Errorf("opaque image: expected 16 colours, got %d", len(pal))
+	}
+
+	pal = indexedPalette(createMaskedImage(32), 4, reserved)
+	if len(pal) > 16 {
+		t.Fatalf("masked image: expected at most 16 colours, got %d", len(pal))
+	}
+	found := false
+	for _, c := range pal {
+		if c == reserved {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("masked image: reserved colour missing from palette")
+	}
+}
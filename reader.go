@@ -5,82 +5,144 @@ import (
 	"encoding/binary"
 	"fmt"
 	"image"
-	"image/color"
-	"image/draw"
 	"image/png"
 	"io"
-
-	bmp "github.com/jsummers/gobmp"
+	"math"
 )
 
-const maxICOSize = int64(64 << 20) // hard cap to avoid OOM panics on hostile inputs
+// Limits applied by the package-level functions and by Decoder fields left
+// at zero.
+const (
+	DefaultMaxFileSize       = 64 << 20 // hard cap to avoid OOM panics on hostile inputs
+	DefaultMaxEntries        = 1024
+	DefaultMaxPixelsPerEntry = 4096 * 4096
+	DefaultMaxTotalPixels    = 4 * DefaultMaxPixelsPerEntry
+)
 
 func init() {
 	image.RegisterFormat("ico", "\x00\x00\x01\x00?????\x00", Decode, DecodeConfig)
+	image.RegisterFormat("cur", "\x00\x00\x02\x00?????\x00", Decode, DecodeConfig)
 }
 
 // ---- public ----
 
+// A Decoder reads icon and cursor files within configurable resource
+// limits, which are checked against the directory and the payload headers
+// before any PNG or BMP payload is decoded. A zero field uses the matching
+// Default constant; a negative field disables that limit.
+type Decoder struct {
+	// MaxFileSize is the largest file, in bytes, that is read.
+	MaxFileSize int64
+	// MaxEntries is the largest number of directory entries accepted.
+	MaxEntries int
+	// MaxPixelsPerEntry bounds the width times height of any decoded entry.
+	MaxPixelsPerEntry int64
+	// MaxTotalPixels bounds the summed pixel count of all entries decoded
+	// by one call.
+	MaxTotalPixels int64
+}
+
 func Decode(r io.Reader) (image.Image, error) {
-	var d decoder
-	if err := d.decode(r); err != nil {
-		return nil, err
-	}
-	if len(d.images) == 0 {
-		return nil, fmt.Errorf("ico: no images")
-	}
-	return d.images[0], nil
+	var dec Decoder
+	return dec.Decode(r)
 }
 
 func DecodeAll(r io.Reader) ([]image.Image, error) {
-	var d decoder
-	if err := d.decode(r); err != nil {
-		return nil, err
-	}
-	return d.images, nil
+	var dec Decoder
+	return dec.DecodeAll(r)
 }
 
 func DecodeConfig(r io.Reader) (image.Config, error) {
-	var (
-		d   decoder
-		cfg image.Config
-		err error
-	)
+	var dec Decoder
+	return dec.DecodeConfig(r)
+}
+
+// DecodeConfigAll returns the color model and dimensions of every entry of
+// the icon or cursor in r. Only the PNG IHDR and palette chunks or the DIB
+// header and colour table of each entry are parsed, never the pixels.
+func DecodeConfigAll(r io.Reader) ([]image.Config, error) {
+	var dec Decoder
+	return dec.DecodeConfigAll(r)
+}
+
+// DecodeAllLenient is like DecodeAll but tolerates broken entries, as
+// browsers and Windows Explorer do. It returns the images of the entries
+// that decode, in directory order, and one error for each entry skipped.
+// Each such error is a *FormatError or a *LimitError whose Entry field
+// identifies the entry, so the images are those of the entries not listed.
+// err is set only if the header or directory is unusable or no entry
+// decodes, in which case it is the first entry error.
+func DecodeAllLenient(r io.Reader) (imgs []image.Image, errs []error, err error) {
+	var dec Decoder
+	return dec.DecodeAllLenient(r)
+}
 
-	file, err := readAllICO(r)
+// Decode returns the first image of the icon or cursor in r.
+func (dec *Decoder) Decode(r io.Reader) (image.Image, error) {
+	d := decoder{limits: *dec}
+	file, err := d.decodeDirectory(r)
 	if err != nil {
-		return cfg, err
+		return nil, err
 	}
 
-	br := bytes.NewReader(file)
-	if err = d.decodeHeader(br); err != nil {
-		return cfg, err
+	info, err := d.entryInfoAt(file, 0)
+	if err != nil {
+		return nil, err
 	}
-	if err = d.decodeEntries(br); err != nil {
-		return cfg, err
+	if err := d.checkPixels([]EntryInfo{info}); err != nil {
+		return nil, err
 	}
-	if len(d.entries) == 0 {
-		return cfg, fmt.Errorf("ico: no images")
+	return d.decodeEntry(file, 0)
+}
+
+// DecodeAll returns every image of the icon or cursor in r.
+func (dec *Decoder) DecodeAll(r io.Reader) ([]image.Image, error) {
+	d := decoder{limits: *dec}
+	if err := d.decode(r); err != nil {
+		return nil, err
 	}
+	return d.images, nil
+}
 
-	e := &(d.entries[0])
-	entryData, err := d.entryBytes(file, e)
-	if err != nil {
-		return cfg, err
+// DecodeAllLenient is like the package-level DecodeAllLenient but applies
+// dec's limits. Entries exceeding MaxPixelsPerEntry, or MaxTotalPixels
+// given the entries before them, are skipped.
+func (dec *Decoder) DecodeAllLenient(r io.Reader) (imgs []image.Image, errs []error, err error) {
+	d := decoder{limits: *dec}
+	if errs, err = d.decodeLenient(r); err != nil {
+		return nil, errs, err
 	}
+	return d.images, errs, nil
+}
 
-	if len(entryData) >= len(pngHeader) && bytes.Equal(entryData[:len(pngHeader)], pngHeader) {
-		return png.DecodeConfig(bytes.NewReader(entryData))
+// DecodeConfig returns the color model and dimensions of the first image
+// of the icon or cursor in r.
+func (dec *Decoder) DecodeConfig(r io.Reader) (image.Config, error) {
+	d := decoder{limits: *dec}
+	file, err := d.decodeDirectory(r)
+	if err != nil {
+		return image.Config{}, err
 	}
 
-	buf := make([]byte, 14+len(entryData))
-	copy(buf[14:], entryData)
+	return d.entryConfigAt(file, 0)
+}
 
-	_, bmpSize, err := d.forgeBMPHead(buf, e)
+// DecodeConfigAll is like the package-level DecodeConfigAll but applies
+// dec's limits.
+func (dec *Decoder) DecodeConfigAll(r io.Reader) ([]image.Config, error) {
+	d := decoder{limits: *dec}
+	file, err := d.decodeDirectory(r)
 	if err != nil {
-		return cfg, err
+		return nil, err
 	}
-	return bmp.DecodeConfig(bytes.NewReader(buf[:bmpSize]))
+
+	cfgs := make([]image.Config, len(d.entries))
+	for i := range d.entries {
+		if cfgs[i], err = d.entryConfigAt(file, i); err != nil {
+			return nil, err
+		}
+	}
+	return cfgs, nil
 }
 
 // ---- private ----
@@ -106,136 +168,199 @@ type decoder struct {
 	head    head
 	entries []direntry
 	images  []image.Image
+	limits  Decoder
 }
 
-func readAllICO(r io.Reader) ([]byte, error) {
-	b, err := io.ReadAll(io.LimitReader(r, maxICOSize+1))
+// limit resolves a Decoder field: zero means def, negative means no limit.
+func limit(v, def int64) int64 {
+	switch {
+	case v == 0:
+		return def
+	case v < 0:
+		return math.MaxInt64
+	}
+	return v
+}
+
+func readAllICO(r io.Reader, maxSize int64) ([]byte, error) {
+	if maxSize == math.MaxInt64 {
+		return io.ReadAll(r)
+	}
+	b, err := io.ReadAll(io.LimitReader(r, maxSize+1))
 	if err != nil {
 		return nil, err
 	}
-	if int64(len(b)) > maxICOSize {
-		return nil, fmt.Errorf("ico: file too large")
+	if int64(len(b)) > maxSize {
+		return nil, limitError("file too large (limit %d bytes)", maxSize)
 	}
 	return b, nil
 }
 
+// checkPixels enforces the pixel limits on the entries about to be decoded.
+func (d *decoder) checkPixels(infos []EntryInfo) error {
+	perEntry := limit(d.limits.MaxPixelsPerEntry, DefaultMaxPixelsPerEntry)
+	total := limit(d.limits.MaxTotalPixels, DefaultMaxTotalPixels)
+
+	var sum int64
+	for i := range infos {
+		w, h := int64(infos[i].ImageWidth), int64(infos[i].ImageHeight)
+		if w < 0 || h < 0 || (w > 0 && h > perEntry/w) {
+			return limitError("entry too large (%dx%d, limit %d pixels)", w, h, perEntry)
+		}
+		if sum += w * h; sum > total {
+			return limitError("images too large in total (limit %d pixels)", total)
+		}
+	}
+	return nil
+}
+
 func (d *decoder) entryBytes(file []byte, e *direntry) ([]byte, error) {
-	start := int64(e.Offset)
+	start, end, err := e.payloadRange(int64(len(file)))
+	if err != nil {
+		return nil, err
+	}
+	return file[int(start):int(end)], nil
+}
+
+// payloadRange returns the byte range of the payload of e within a file of
+// fileSize bytes.
+func (e *direntry) payloadRange(fileSize int64) (start, end int64, err error) {
+	start = int64(e.Offset)
 	size := int64(e.Size)
 	if size <= 0 {
-		return nil, fmt.Errorf("ico: corrupted entry (size=%d)", e.Size)
+		return 0, 0, formatError(nil, "corrupted entry (size=%d)", e.Size)
 	}
-	end := start + size
-	if start < 0 || end < start || end > int64(len(file)) {
-		return nil, io.ErrUnexpectedEOF
+	end = start + size
+	if start < 0 || end < start || end > fileSize {
+		return 0, 0, formatError(io.ErrUnexpectedEOF, "payload of %d bytes past end of %d-byte file", size, fileSize)
 	}
-	return file[int(start):int(end)], nil
+	return start, end, nil
 }
 
-func (d *decoder) decode(r io.Reader) (err error) {
-	file, err := readAllICO(r)
+// decodeDirectory reads the whole file from r and parses its header and
+// directory, returning the file contents for entryBytes.
+func (d *decoder) decodeDirectory(r io.Reader) ([]byte, error) {
+	file, err := readAllICO(r, limit(d.limits.MaxFileSize, DefaultMaxFileSize))
 	if err != nil {
+		return nil, err
+	}
+
+	if err = d.parseDirectory(bytes.NewReader(file)); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// parseDirectory parses the header and directory at the start of r.
+func (d *decoder) parseDirectory(r io.Reader) error {
+	if err := d.decodeHeader(r); err != nil {
 		return err
 	}
+	if n, max := int64(d.head.Number), limit(int64(d.limits.MaxEntries), DefaultMaxEntries); n > max {
+		return limitError("too many entries (%d > %d)", n, max)
+	}
+	return d.decodeEntries(r)
+}
 
-	br := bytes.NewReader(file)
-	if err = d.decodeHeader(br); err != nil {
+func (d *decoder) decode(r io.Reader) error {
+	file, err := d.decodeDirectory(r)
+	if err != nil {
 		return err
 	}
-	if err = d.decodeEntries(br); err != nil {
+	return d.decodeImages(file)
+}
+
+// decodeImages decodes every entry of file into d.images, once the
+// directory has been parsed.
+func (d *decoder) decodeImages(file []byte) error {
+	infos, err := d.entryInfos(file)
+	if err != nil {
+		return err
+	}
+	if err = d.checkPixels(infos); err != nil {
 		return err
 	}
 
 	d.images = make([]image.Image, len(d.entries))
 	for i := range d.entries {
-		e := &(d.entries[i])
-
-		entryData, err := d.entryBytes(file, e)
-		if err != nil {
+		if d.images[i], err = d.decodeEntry(file, i); err != nil {
 			return err
 		}
+	}
 
-		if len(entryData) >= len(pngHeader) && bytes.Equal(entryData[:len(pngHeader)], pngHeader) { // decode as PNG
-			if d.images[i], err = png.Decode(bytes.NewReader(entryData)); err != nil {
-				return err
-			}
-			continue
-		}
+	return nil
+}
 
-		// decode as BMP
-		data := make([]byte, 14+len(entryData))
-		copy(data[14:], entryData)
+// decodeLenient decodes every entry it can into d.images, collecting the
+// errors of the others.
+func (d *decoder) decodeLenient(r io.Reader) (errs []error, err error) {
+	file, err := d.decodeDirectory(r)
+	if err != nil {
+		return nil, err
+	}
 
-		maskData, bmpSize, err := d.forgeBMPHead(data, e)
+	var kept []EntryInfo
+	for i := range d.entries {
+		info, err := d.entryInfoAt(file, i)
 		if err != nil {
-			return err
+			errs = append(errs, err)
+			continue
 		}
-
-		bmpImg, err := bmp.Decode(bytes.NewReader(data[:bmpSize]))
-		if err != nil {
-			return err
+		if err := d.checkPixels(append(kept, info)); err != nil {
+			errs = append(errs, d.entryError(i, err))
+			continue
 		}
-
-		bounds := bmpImg.Bounds()
-		w, h := bounds.Dx(), bounds.Dy()
-		if w <= 0 || h <= 0 {
-			d.images[i] = bmpImg
+		img, err := d.decodeEntry(file, i)
+		if err != nil {
+			errs = append(errs, err)
 			continue
 		}
+		kept = append(kept, info)
+		d.images = append(d.images, img)
+	}
 
-		mask := image.NewAlpha(image.Rect(0, 0, w, h))
-		masked := image.NewNRGBA(image.Rect(0, 0, w, h))
-
-		if maskData != nil {
-			rowSize := (w + 31) / 32 * 4
-			need := rowSize * h
-			if need > len(maskData) {
-				return fmt.Errorf("ico: corrupted mask data")
-			}
-			for row := 0; row < h; row++ {
-				rowOff := row * rowSize
-				for col := 0; col < w; col++ {
-					if (maskData[rowOff+col/8]>>(7-uint(col)%8))&0x01 != 1 {
-						mask.SetAlpha(col, h-row-1, color.Alpha{255})
-					}
-				}
-			}
-		} else { // 32-Bit (alpha in pixel data)
-			bmpData := data[:bmpSize]
-			if len(bmpData) < 14 {
-				return fmt.Errorf("ico: corrupted bmp data")
-			}
-
-			rowSize := (w*32 + 31) / 32 * 4
-			offset := int(binary.LittleEndian.Uint32(bmpData[10:14]))
-			if offset < 0 || offset+rowSize*h > len(bmpData) {
-				return fmt.Errorf("ico: corrupted bmp alpha data")
-			}
-
-			for row := 0; row < h; row++ {
-				rowOff := offset + row*rowSize
-				for col := 0; col < w; col++ {
-					mask.SetAlpha(col, h-row-1, color.Alpha{bmpData[rowOff+col*4+3]})
-				}
-			}
-		}
+	if len(d.images) == 0 {
+		return errs, errs[0]
+	}
+	return errs, nil
+}
 
-		draw.DrawMask(masked, masked.Bounds(), bmpImg, bounds.Min, mask, bounds.Min, draw.Src)
-		d.images[i] = masked
+// decodeEntry decodes the image of entry i.
+func (d *decoder) decodeEntry(file []byte, i int) (image.Image, error) {
+	e := &(d.entries[i])
+	entryData, err := d.entryBytes(file, e)
+	if err != nil {
+		return nil, d.entryError(i, err)
+	}
+	img, err := d.decodePayload(e, entryData)
+	if err != nil {
+		return nil, d.entryError(i, err)
 	}
+	return img, nil
+}
 
-	return nil
+// decodePayload decodes the PNG or BMP payload of e.
+func (d *decoder) decodePayload(e *direntry, entryData []byte) (image.Image, error) {
+	if isPNG(entryData) { // decode as PNG
+		img, err := png.Decode(bytes.NewReader(entryData))
+		if err != nil {
+			return nil, formatError(err, "invalid png payload")
+		}
+		return img, nil
+	}
+
+	return decodeDIB(entryData, e)
 }
 
 func (d *decoder) decodeHeader(r io.Reader) error {
 	if err := binary.Read(r, binary.LittleEndian, &(d.head)); err != nil {
-		return err
+		return &FormatError{Entry: -1, Offset: 0, Reason: "truncated head", Err: io.ErrUnexpectedEOF}
 	}
-	if d.head.Zero != 0 || d.head.Type != 1 {
-		return fmt.Errorf("corrupted head: [%x,%x]", d.head.Zero, d.head.Type)
+	if d.head.Zero != 0 || (d.head.Type != typeIcon && d.head.Type != typeCursor) {
+		return &FormatError{Entry: -1, Offset: 0, Reason: fmt.Sprintf("corrupted head: [%x,%x]", d.head.Zero, d.head.Type)}
 	}
 	if d.head.Number == 0 {
-		return fmt.Errorf("ico: no images")
+		return ErrNoImages
 	}
 	return nil
 }
@@ -245,61 +370,15 @@ func (d *decoder) decodeEntries(r io.Reader) error {
 	d.entries = make([]direntry, n)
 	for i := 0; i < n; i++ {
 		if err := binary.Read(r, binary.LittleEndian, &(d.entries[i])); err != nil {
-			return err
+			return &FormatError{Entry: i, Offset: int64(headSize + i*direntrySize), Reason: "truncated directory", Err: io.ErrUnexpectedEOF}
 		}
 	}
 	return nil
 }
 
-func (d *decoder) forgeBMPHead(buf []byte, e *direntry) (mask []byte, bmpSize int, err error) {
-	// See en.wikipedia.org/wiki/BMP_file_format
-	if len(buf) < 14+4 {
-		return nil, 0, io.ErrUnexpectedEOF
-	}
-
-	data := buf[14:]
-	if len(data) < 4 {
-		return nil, 0, io.ErrUnexpectedEOF
-	}
-
-	dibSize := binary.LittleEndian.Uint32(data[:4])
-	if dibSize < 12 {
-		return nil, 0, fmt.Errorf("ico: corrupted DIB header size (%d)", dibSize)
-	}
-	if len(data) < int(dibSize) {
-		return nil, 0, io.ErrUnexpectedEOF
-	}
-
-	var (
-		w         uint32
-		h         uint32
-		bits      uint16
-		numColors uint32
-	)
-
-	switch dibSize {
-	case 12: // BITMAPCOREHEADER
-		if len(data) < 12 {
-			return nil, 0, io.ErrUnexpectedEOF
-		}
-		w = uint32(binary.LittleEndian.Uint16(data[4:6]))
-		h = uint32(binary.LittleEndian.Uint16(data[6:8]))
-		bits = binary.LittleEndian.Uint16(data[10:12])
-		numColors = 0
-	default: // BITMAPINFOHEADER and later
-		if len(data) < 16 {
-			return nil, 0, io.ErrUnexpectedEOF
-		}
-		w = binary.LittleEndian.Uint32(data[4:8])
-		h = binary.LittleEndian.Uint32(data[8:12])
-		bits = binary.LittleEndian.Uint16(data[14:16])
-		if len(data) >= 36 {
-			numColors = binary.LittleEndian.Uint32(data[32:36])
-		} else {
-			numColors = 0
-		}
-	}
-
+// xorHeight returns the height of the XOR bitmap of a DIB entry whose
+// header declares w x h pixels.
+func (e *direntry) xorHeight(w, h uint32) uint32 {
 	// ICO BMP height is commonly stored as (XOR+AND) i.e. 2*height.
 	// Keep the old heuristic but also handle non-square entries via the directory height.
 	entryH := uint32(e.Height)
@@ -309,71 +388,10 @@ func (d *decoder) forgeBMPHead(buf []byte, e *direntry) (mask []byte, bmpSize in
 	if h%2 == 0 {
 		half := h / 2
 		if half == entryH || half == w || h > w {
-			h = half
-			if dibSize == 12 {
-				if h > 0xFFFF {
-					return nil, 0, fmt.Errorf("ico: corrupted bmp height (%d)", h)
-				}
-				binary.LittleEndian.PutUint16(data[6:8], uint16(h))
-			} else {
-				binary.LittleEndian.PutUint32(data[8:12], h)
-			}
+			return half
 		}
 	}
-
-	imageSize := int64(len(data))
-	if bits != 32 {
-		if w == 0 || h == 0 {
-			return nil, 0, fmt.Errorf("ico: corrupted bmp dimensions")
-		}
-		rowSize := (int64(w) + 31) / 32 * 4
-		maskSize := rowSize * int64(h)
-		if maskSize <= 0 || maskSize > imageSize {
-			return nil, 0, fmt.Errorf("ico: corrupted bmp mask size")
-		}
-		imageSize -= maskSize
-		if imageSize <= 0 {
-			return nil, 0, fmt.Errorf("ico: corrupted bmp image size")
-		}
-		mask = data[int(imageSize):]
-	}
-
-	copy(buf[0:2], "\x42\x4D") // Magic number
-
-	bmpSize = 14 + int(imageSize)
-	binary.LittleEndian.PutUint32(buf[2:6], uint32(bmpSize)) // File size
-
-	// Calculate offset into image data
-	switch bits {
-	case 1, 2, 4, 8:
-		x := uint32(1) << bits
-		if numColors == 0 || numColors > x {
-			numColors = x
-		}
-	default:
-		numColors = 0
-	}
-
-	var numColorsSize uint32
-	switch dibSize {
-	case 12, 64:
-		numColorsSize = numColors * 3
-	default:
-		numColorsSize = numColors * 4
-	}
-
-	offset := uint32(14) + dibSize + numColorsSize
-	ds := int(dibSize)
-	if dibSize > 40 && ds >= 8 && ds-4 <= len(data) {
-		offset += binary.LittleEndian.Uint32(data[ds-8 : ds-4])
-	}
-
-	if offset >= uint32(bmpSize) {
-		return nil, 0, fmt.Errorf("ico: corrupted bmp data offset")
-	}
-
-	binary.LittleEndian.PutUint32(buf[10:14], offset)
-	return mask, bmpSize, nil
+	return h
 }
 
 var pngHeader = []byte{'\x89', 'P', 'N', 'G', '\r', '\n', '\x1a', '\n'}
@@ -1,9 +1,14 @@
 package ico
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"image/png"
+	"io"
 	"math"
 	"os"
 	"strings"
@@ -496,3 +501,307 @@ func TestDecodeConfigErrors(t *testing.T) {
 		})
 	}
 }
+
+// TestDecodeConfigAll tests DecodeConfigAll on every entry of the fixture files
+func TestDecodeConfigAll(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		file     string
+		sizes    []int
+		paletted []int // palette length per entry, 0 if not paletted
+	}{
+		{"testdata/multi_sizes.ico", []int{16, 32, 48, 256}, []int{0, 0, 0, 0}},
+		{"testdata/bmp_format.ico", []int{32}, []int{0}},
+		{"testdata/24bit.ico", []int{32}, []int{0}},
+		{"testdata/8bit.ico", []int{32}, []int{256}},
+		{"testdata/4bit.ico", []int{32}, []int{16}},
+		{"testdata/1bit.ico", []int{32}, []int{2}},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.file, func(t *testing.T) {
+			t.Parallel()
+
+			reader, err := os.Open(tc.file)
+			if err != nil {
+				t.Fatalf("failed to open test file: %v", err)
+			}
+			defer reader.Close()
+
+			cfgs, err := DecodeConfigAll(reader)
+			if err != nil {
+				t.Fatalf("failed to decode configs: %v", err)
+			}
+			if len(cfgs) != len(tc.sizes) {
+				t.Fatalf("expected %d configs, got %d", len(tc.sizes), len(cfgs))
+			}
+			for i, cfg := range cfgs {
+				if cfg.Width != tc.sizes[i] || cfg.Height != tc.sizes[i] {
+					t.Errorf("entry %d: expected %dx%d, got %dx%d", i, tc.sizes[i], tc.sizes[i], cfg.Width, cfg.Height)
+				}
+				pal, ok := cfg.ColorModel.(color.Palette)
+				if tc.paletted[i] == 0 {
+					if ok {
+						t.Errorf("entry %d: unexpected palette color model", i)
+					}
+					continue
+				}
+				if !ok || len(pal) != tc.paletted[i] {
+					t.Errorf("entry %d: expected palette of %d colours, got %T", i, tc.paletted[i], cfg.ColorModel)
+				}
+			}
+		})
+	}
+}
+
+// TestDecodeConfigAllPalette tests that palette color models match the encoded palette
+func TestDecodeConfigAllPalette(t *testing.T) {
+	t.Parallel()
+
+	img := createPalettedImage(32, 3)
+	var buf bytes.Buffer
+	enc := Encoder{Bits: 4}
+	err := enc.EncodeEntries(&buf, []EntryImage{
+		{Image: img, Format: FormatBMP},
+		{Image: img, Format: FormatPNG},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+
+	cfgs, err := DecodeConfigAll(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to decode configs: %v", err)
+	}
+	for i, cfg := range cfgs {
+		pal, ok := cfg.ColorModel.(color.Palette)
+		if !ok {
+			t.Fatalf("entry %d: expected color.Palette, got %T", i, cfg.ColorModel)
+		}
+		for _, c := range []color.Color{img.At(5, 5), img.At(6, 5), img.At(7, 5)} {
+			r1, g1, b1, a1 := c.RGBA()
+			r2, g2, b2, a2 := pal.Convert(c).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				t.Errorf("entry %d: colour %v missing from palette", i, c)
+			}
+		}
+	}
+}
+
+// TestDecoderLimits tests that Decoder limits are enforced before decoding
+func TestDecoderLimits(t *testing.T) {
+	t.Parallel()
+
+	multi, err := os.ReadFile("testdata/multi_sizes.ico")
+	if err != nil {
+		t.Fatalf("failed to read multi_sizes.ico: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		decoder     Decoder
+		decode      func(*Decoder, io.Reader) error
+		expectError string
+	}{
+		{
+			name:        "file size",
+			decoder:     Decoder{MaxFileSize: 1000},
+			decode:      decodeAllFunc,
+			expectError: "file too large",
+		},
+		{
+			name:        "entries",
+			decoder:     Decoder{MaxEntries: 3},
+			decode:      decodeAllFunc,
+			expectError: "too many entries",
+		},
+		{
+			name:        "entries for directory",
+			decoder:     Decoder{MaxEntries: 3},
+			decode:      func(dec *Decoder, r io.Reader) error { _, err := dec.ReadDirectory(r); return err },
+			expectError: "too many entries",
+		},
+		{
+			name:        "pixels per entry",
+			decoder:     Decoder{MaxPixelsPerEntry: 64 * 64},
+			decode:      decodeAllFunc,
+			expectError: "entry too large",
+		},
+		{
+			name:        "total pixels",
+			decoder:     Decoder{MaxTotalPixels: 256*256 + 100},
+			decode:      decodeAllFunc,
+			expectError: "too large in total",
+		},
+		{
+			name:    "best entry within limits",
+			decoder: Decoder{MaxPixelsPerEntry: 64 * 64},
+			decode: func(dec *Decoder, r io.Reader) error {
+				_, err := dec.DecodeBest(r, 32, 32)
+				return err
+			},
+		},
+		{
+			name:    "limits disabled",
+			decoder: Decoder{MaxFileSize: -1, MaxEntries: -1, MaxPixelsPerEntry: -1, MaxTotalPixels: -1},
+			decode:  decodeAllFunc,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.decode(&tc.decoder, bytes.NewReader(multi))
+			if tc.expectError == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !strings.Contains(err.Error(), tc.expectError) {
+				t.Errorf("expected error containing %q, got %q", tc.expectError, err.Error())
+			}
+		})
+	}
+}
+
+// TestDecodeHugeDIBHeader tests that absurd DIB dimensions are rejected by the default limits
+func TestDecodeHugeDIBHeader(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	enc := Encoder{Format: FormatBMP}
+	if err := enc.Encode(&buf, createMaskedImage(16)); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	data := buf.Bytes()
+	dib := data[headSize+direntrySize:]
+	binary.LittleEndian.PutUint32(dib[4:8], 1<<20)
+	binary.LittleEndian.PutUint32(dib[8:12], 2<<20)
+
+	_, err := Decode(bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), "entry too large") {
+		t.Errorf("expected entry too large error, got %v", err)
+	}
+}
+
+// TestDecodeAllLenient tests that broken entries are skipped and reported
+func TestDecodeAllLenient(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	var enc Encoder
+	err := enc.EncodeEntries(&buf, []EntryImage{
+		{Image: createMaskedImage(16), Format: FormatBMP},
+		{Image: createTestImageForWrite(32), Format: FormatPNG},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	data := buf.Bytes()
+	// Cut the DIB of the first entry short of its header.
+	binary.LittleEndian.PutUint32(data[headSize+8:], 10)
+
+	if _, err := DecodeAll(bytes.NewReader(data)); err == nil {
+		t.Fatal("expected DecodeAll to fail, got nil")
+	}
+
+	imgs, errs, err := DecodeAllLenient(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(imgs) != 1 || imgs[0].Bounds().Dx() != 32 {
+		t.Fatalf("expected the 32x32 entry only, got %d images", len(imgs))
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 entry error, got %v", errs)
+	}
+	var fe *FormatError
+	if !errors.As(errs[0], &fe) || fe.Entry != 0 || !errors.Is(errs[0], io.ErrUnexpectedEOF) {
+		t.Errorf("expected truncated entry 0, got %v", errs[0])
+	}
+
+	// Limits skip entries instead of failing the file.
+	dec := Decoder{MaxPixelsPerEntry: 16 * 16}
+	imgs, errs, err = dec.DecodeAllLenient(bytes.NewReader(buf.Bytes()))
+	if err == nil {
+		t.Fatalf("expected error when no entry decodes, got %d images", len(imgs))
+	}
+	if len(errs) != 2 || !errors.Is(errs[1], ErrLimitExceeded) {
+		t.Errorf("expected limit error for entry 1, got %v", errs)
+	}
+	if !errors.Is(err, ErrFormat) {
+		t.Errorf("expected first entry error, got %v", err)
+	}
+
+	// Header errors are still fatal.
+	if _, _, err := DecodeAllLenient(bytes.NewReader(data[:4])); !errors.Is(err, ErrFormat) {
+		t.Errorf("expected header error, got %v", err)
+	}
+}
+
+// TestDecodeAllLenientEntries tests that every skipped entry is identified,
+// whether broken or over a limit, so images map back to their entries
+func TestDecodeAllLenientEntries(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	var enc Encoder
+	err := enc.EncodeEntries(&buf, []EntryImage{
+		{Image: createMaskedImage(16), Format: FormatBMP},
+		{Image: createTestImageForWrite(64), Format: FormatPNG},
+		{Image: createTestImageForWrite(32), Format: FormatPNG},
+		{Image: createMaskedImage(24), Format: FormatBMP},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data[headSize+8:], 10)
+
+	dec := Decoder{MaxPixelsPerEntry: 32 * 32}
+	imgs, errs, err := dec.DecodeAllLenient(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 entry errors, got %v", errs)
+	}
+	var fe *FormatError
+	if !errors.As(errs[0], &fe) || fe.Entry != 0 {
+		t.Errorf("expected format error for entry 0, got %v", errs[0])
+	}
+	var le *LimitError
+	if !errors.As(errs[1], &le) || le.Entry != 1 || !errors.Is(errs[1], ErrLimitExceeded) || errors.Is(errs[1], ErrFormat) {
+		t.Errorf("expected limit error for entry 1, got %v", errs[1])
+	}
+
+	skipped := map[int]bool{fe.Entry: true, le.Entry: true}
+	var entries []int
+	for i := 0; i < 4; i++ {
+		if !skipped[i] {
+			entries = append(entries, i)
+		}
+	}
+	wantSizes := map[int]int{2: 32, 3: 24}
+	if len(imgs) != len(entries) {
+		t.Fatalf("expected %d images, got %d", len(entries), len(imgs))
+	}
+	for k, i := range entries {
+		if w := imgs[k].Bounds().Dx(); w != wantSizes[i] {
+			t.Errorf("image %d: expected entry %d of width %d, got %d", k, i, wantSizes[i], w)
+		}
+	}
+}
+
+func decodeAllFunc(dec *Decoder, r io.Reader) error {
+	_, err := dec.DecodeAll(r)
+	return err
+}
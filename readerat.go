@@ -0,0 +1,138 @@
+package ico
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// infoPrefixSize is enough of a payload for entryInfo: the PNG signature
+// and IHDR chunk, or the start of any DIB header.
+const infoPrefixSize = 64
+
+// configPrefixSize is enough of a DIB payload for entryConfig: the largest
+// DIB header, BITMAPV5HEADER, and a full 8-bit colour table.
+const configPrefixSize = 124 + 256*4
+
+// A Reader gives random access to the entries of an icon or cursor file.
+// Opening it parses only the header and directory; each entry is read from
+// the underlying io.ReaderAt when asked for.
+type Reader struct {
+	r    io.ReaderAt
+	size int64
+	d    decoder
+}
+
+// A ReaderEntry is one entry of a Reader.
+type ReaderEntry struct {
+	r *Reader
+	i int
+}
+
+// OpenReader parses the header and directory of the icon or cursor file of
+// size bytes held by r.
+func OpenReader(r io.ReaderAt, size int64) (*Reader, error) {
+	var dec Decoder
+	return dec.OpenReader(r, size)
+}
+
+// OpenReader is like the package-level OpenReader but applies dec's limits.
+// MaxEntries bounds the directory and MaxPixelsPerEntry each decoded entry.
+// MaxFileSize bounds the payload read for a single entry rather than size,
+// and MaxTotalPixels does not apply since entries are decoded one by one.
+func (dec *Decoder) OpenReader(r io.ReaderAt, size int64) (*Reader, error) {
+	rd := &Reader{r: r, size: size, d: decoder{limits: *dec}}
+	if err := rd.d.parseDirectory(io.NewSectionReader(r, 0, size)); err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+// Len returns the number of entries in the directory.
+func (r *Reader) Len() int {
+	return len(r.d.entries)
+}
+
+// Entry returns entry i of the directory. It panics if i is out of range.
+func (r *Reader) Entry(i int) *ReaderEntry {
+	_ = r.d.entries[i]
+	return &ReaderEntry{r: r, i: i}
+}
+
+// Info describes the entry, reading only the header of its payload.
+func (e *ReaderEntry) Info() (EntryInfo, error) {
+	payload, err := e.read(infoPrefixSize)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	info, err := e.r.d.entryInfo(e.direntry(), payload)
+	if err != nil {
+		return EntryInfo{}, e.r.d.entryError(e.i, err)
+	}
+	return info, nil
+}
+
+// Config returns the color model and dimensions of the entry, reading only
+// the headers and colour table of its payload.
+func (e *ReaderEntry) Config() (image.Config, error) {
+	payload, err := e.read(configPrefixSize)
+	if err != nil {
+		return image.Config{}, err
+	}
+	cfg, err := e.r.d.entryConfig(e.direntry(), payload)
+	if err != nil {
+		return image.Config{}, e.r.d.entryError(e.i, err)
+	}
+	return cfg, nil
+}
+
+// Image reads and decodes the entry.
+func (e *ReaderEntry) Image() (image.Image, error) {
+	payload, err := e.read(-1)
+	if err != nil {
+		return nil, err
+	}
+	d := &e.r.d
+	info, err := d.entryInfo(e.direntry(), payload)
+	if err != nil {
+		return nil, d.entryError(e.i, err)
+	}
+	if err := d.checkPixels([]EntryInfo{info}); err != nil {
+		return nil, err
+	}
+	img, err := d.decodePayload(e.direntry(), payload)
+	if err != nil {
+		return nil, d.entryError(e.i, err)
+	}
+	return img, nil
+}
+
+func (e *ReaderEntry) direntry() *direntry {
+	return &e.r.d.entries[e.i]
+}
+
+// read returns the first n bytes of the payload, or all of it if n is
+// negative or the payload is shorter.
+func (e *ReaderEntry) read(n int64) ([]byte, error) {
+	d := &e.r.d
+	start, end, err := e.direntry().payloadRange(e.r.size)
+	if err != nil {
+		return nil, d.entryError(e.i, err)
+	}
+	if n < 0 || n > end-start {
+		n = end - start
+	}
+	if max := limit(d.limits.MaxFileSize, DefaultMaxFileSize); n > max {
+		return nil, limitError("entry payload too large (%d bytes, limit %d)", n, max)
+	}
+
+	buf := make([]byte, n)
+	if m, err := e.r.r.ReadAt(buf, start); m < len(buf) {
+		if err == nil || errors.Is(err, io.EOF) {
+			err = formatError(io.ErrUnexpectedEOF, "payload past end of data")
+			return nil, d.entryError(e.i, err)
+		}
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,139 @@
+package ico
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// countingReaderAt records the furthest byte read.
+type countingReaderAt struct {
+	r   io.ReaderAt
+	end int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	if end := off + int64(n); end > c.end {
+		c.end = end
+	}
+	return n, err
+}
+
+// TestOpenReader tests that lazily decoded entries match DecodeAll
+func TestOpenReader(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open("testdata/multi_sizes.ico")
+	if err != nil {
+		t.Fatalf("failed to open multi_sizes.ico: %v", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("failed to stat multi_sizes.ico: %v", err)
+	}
+
+	cr := &countingReaderAt{r: f}
+	r, err := OpenReader(cr, fi.Size())
+	if err != nil {
+		t.Fatalf("failed to open reader: %v", err)
+	}
+	if want := int64(headSize + r.Len()*direntrySize); cr.end != want {
+		t.Errorf("expected %d bytes read on open, got %d", want, cr.end)
+	}
+
+	data, err := os.ReadFile("testdata/multi_sizes.ico")
+	if err != nil {
+		t.Fatalf("failed to read multi_sizes.ico: %v", err)
+	}
+	imgs, err := DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	infos, err := ReadDirectory(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	cfgs, err := DecodeConfigAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode configs: %v", err)
+	}
+	if r.Len() != len(imgs) {
+		t.Fatalf("expected %d entries, got %d", len(imgs), r.Len())
+	}
+
+	for i := 0; i < r.Len(); i++ {
+		e := r.Entry(i)
+
+		info, err := e.Info()
+		if err != nil {
+			t.Fatalf("entry %d: failed to read info: %v", i, err)
+		}
+		if info != infos[i] {
+			t.Errorf("entry %d: expected info %+v, got %+v", i, infos[i], info)
+		}
+
+		cfg, err := e.Config()
+		if err != nil {
+			t.Fatalf("entry %d: failed to read config: %v", i, err)
+		}
+		if cfg.Width != cfgs[i].Width || cfg.Height != cfgs[i].Height || !reflect.DeepEqual(cfg.ColorModel, cfgs[i].ColorModel) {
+			t.Errorf("entry %d: expected config %+v, got %+v", i, cfgs[i], cfg)
+		}
+
+		img, err := e.Image()
+		if err != nil {
+			t.Fatalf("entry %d: failed to decode: %v", i, err)
+		}
+		if !reflect.DeepEqual(img, imgs[i]) {
+			t.Errorf("entry %d: image differs from DecodeAll", i)
+		}
+	}
+}
+
+// TestOpenReaderErrors tests errors reported by Reader entries
+func TestOpenReaderErrors(t *testing.T) {
+	t.Parallel()
+
+	data, err := os.ReadFile("testdata/multi_sizes.ico")
+	if err != nil {
+		t.Fatalf("failed to read multi_sizes.ico: %v", err)
+	}
+
+	if _, err := OpenReader(bytes.NewReader(data), 4); !errors.Is(err, ErrFormat) {
+		t.Errorf("expected format error for truncated header, got %v", err)
+	}
+
+	dec := Decoder{MaxEntries: 1}
+	if _, err := dec.OpenReader(bytes.NewReader(data), int64(len(data))); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected limit error, got %v", err)
+	}
+
+	// A size larger than the data makes the last payload unreadable.
+	r, err := OpenReader(bytes.NewReader(data[:len(data)-1]), int64(len(data)))
+	if err != nil {
+		t.Fatalf("failed to open reader: %v", err)
+	}
+	last := r.Len() - 1
+	_, err = r.Entry(last).Image()
+	var fe *FormatError
+	if !errors.As(err, &fe) || fe.Entry != last || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected truncated entry %d, got %v", last, err)
+	}
+
+	dec = Decoder{MaxPixelsPerEntry: 64 * 64}
+	r, err = dec.OpenReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("failed to open reader: %v", err)
+	}
+	if _, err := r.Entry(0).Image(); err != nil {
+		t.Errorf("entry 0: unexpected error: %v", err)
+	}
+	if _, err := r.Entry(last).Image(); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected limit error for entry %d, got %v", last, err)
+	}
+}
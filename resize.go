@@ -0,0 +1,182 @@
+package ico
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// premultiplied is an image held as premultiplied RGBA floats in [0, 1], so
+// that resampling does not bleed the colour of transparent pixels into
+// their neighbours.
+type premultiplied struct {
+	w, h int
+	pix  []float32 // 4 values per pixel, row-major
+}
+
+func newPremultiplied(src image.Image) *premultiplied {
+	b := src.Bounds()
+	p := &premultiplied{w: b.Dx(), h: b.Dy(), pix: make([]float32, 4*b.Dx()*b.Dy())}
+	i := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, b, a := src.At(x, y).RGBA()
+			p.pix[i+0] = float32(r) / 0xffff
+			p.pix[i+1] = float32(g) / 0xffff
+			p.pix[i+2] = float32(b) / 0xffff
+			p.pix[i+3] = float32(a) / 0xffff
+			i += 4
+		}
+	}
+	return p
+}
+
+// resize scales p to width x height with a Catmull-Rom filter, widened when
+// downscaling so that every source pixel contributes to the result.
+func (p *premultiplied) resize(width, height int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	if width <= 0 || height <= 0 || p.w == 0 || p.h == 0 {
+		return dst
+	}
+
+	// Horizontal pass: p.h rows of width pixels.
+	xw := resampleWeights(p.w, width)
+	tmp := make([]float32, 4*width*p.h)
+	for y := 0; y < p.h; y++ {
+		row := p.pix[4*y*p.w:]
+		out := tmp[4*y*width:]
+		for x, k := range xw {
+			var r, g, b, a float32
+			for j, wt := range k.weights {
+				s := row[4*(k.start+j):]
+				r += s[0] * wt
+				g += s[1] * wt
+				b += s[2] * wt
+				a += s[3] * wt
+			}
+			out[4*x+0], out[4*x+1], out[4*x+2], out[4*x+3] = r, g, b, a
+		}
+	}
+
+	// Vertical pass straight into dst.
+	yw := resampleWeights(p.h, height)
+	for y, k := range yw {
+		for x := 0; x < width; x++ {
+			var r, g, b, a float32
+			for j, wt := range k.weights {
+				s := tmp[4*((k.start+j)*width+x):]
+				r += s[0] * wt
+				g += s[1] * wt
+				b += s[2] * wt
+				a += s[3] * wt
+			}
+			dst.SetNRGBA(x, y, unpremultiply(r, g, b, a))
+		}
+	}
+	return dst
+}
+
+// unpremultiply converts a filtered pixel back to 8-bit NRGBA. Colour is
+// divided by the unclamped alpha so that filter overshoot near edges
+// cancels out instead of shifting the hue.
+func unpremultiply(r, g, b, a float32) color.NRGBA {
+	if a <= 0 {
+		return color.NRGBA{}
+	}
+	channel := func(v float32) uint8 {
+		return uint8(clamp01(v/a)*0xff + 0.5)
+	}
+	return color.NRGBA{R: channel(r), G: channel(g), B: channel(b), A: uint8(clamp01(a)*0xff + 0.5)}
+}
+
+func clamp01(v float32) float32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+// kernelWeights are the normalised filter taps for one output pixel,
+// applied to source pixels start, start+1, ...
+type kernelWeights struct {
+	start   int
+	weights []float32
+}
+
+// resampleWeights computes the taps mapping srcLen source pixels onto
+// dstLen output pixels along one axis.
+func resampleWeights(srcLen, dstLen int) []kernelWeights {
+	scale := float64(srcLen) / float64(dstLen)
+	stretch := math.Max(scale, 1)
+	support := 2 * stretch
+
+	out := make([]kernelWeights, dstLen)
+	for i := range out {
+		center := (float64(i) + 0.5) * scale
+		lo := int(math.Floor(center - support))
+		hi := int(math.Ceil(center + support))
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > srcLen {
+			hi = srcLen
+		}
+
+		ws := make([]float32, hi-lo)
+		var sum float64
+		for j := lo; j < hi; j++ {
+			v := catmullRom((float64(j) + 0.5 - center) / stretch)
+			ws[j-lo] = float32(v)
+			sum += v
+		}
+		if sum != 0 {
+			for j := range ws {
+				ws[j] = float32(float64(ws[j]) / sum)
+			}
+		}
+		out[i] = kernelWeights{start: lo, weights: ws}
+	}
+	return out
+}
+
+func catmullRom(x float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x < 1:
+		return (1.5*x-2.5)*x*x + 1
+	case x < 2:
+		return ((-0.5*x+2.5)*x-4)*x + 2
+	}
+	return 0
+}
+
+// fitSquare scales p to fit a size x size square, keeping its aspect ratio
+// and centring it on a transparent background.
+func (p *premultiplied) fitSquare(size int) *image.NRGBA {
+	w, h := size, size
+	if p.w > p.h {
+		h = int(math.Round(float64(size) * float64(p.h) / float64(p.w)))
+	} else if p.h > p.w {
+		w = int(math.Round(float64(size) * float64(p.w) / float64(p.h)))
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	scaled := p.resize(w, h)
+	if w == size && h == size {
+		return scaled
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	x0, y0 := (size-w)/2, (size-h)/2
+	for y := 0; y < h; y++ {
+		copy(dst.Pix[dst.PixOffset(x0, y0+y):], scaled.Pix[scaled.PixOffset(0, y):scaled.PixOffset(w, y)])
+	}
+	return dst
+}
@@ -0,0 +1,89 @@
+package ico
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestResizeIdentity tests that resizing to the same size keeps pixels unchanged
+func TestResizeIdentity(t *testing.T) {
+	t.Parallel()
+
+	img := createTestImageForWrite(32)
+	got := newPremultiplied(img).resize(32, 32)
+
+	diff, err := fastCompare(img, got)
+	if err != nil {
+		t.Fatalf("comparison error: %v", err)
+	}
+	if diff != 0 {
+		t.Errorf("pixels differ by %d", diff)
+	}
+}
+
+// TestResizeDownscale tests downscaling of solid and partly transparent images
+func TestResizeDownscale(t *testing.T) {
+	t.Parallel()
+
+	solid := color.NRGBA{R: 200, G: 100, B: 50, A: 255}
+	img := image.NewNRGBA(image.Rect(0, 0, 1024, 1024))
+	for y := 0; y < 1024; y++ {
+		for x := 0; x < 1024; x++ {
+			if x < 512 {
+				img.SetNRGBA(x, y, solid)
+			}
+		}
+	}
+
+	src := newPremultiplied(img)
+	for _, size := range []int{256, 48, 16, 1} {
+		got := src.resize(size, size)
+		if b := got.Bounds(); b.Dx() != size || b.Dy() != size {
+			t.Fatalf("expected %dx%d, got %v", size, size, b)
+		}
+
+		// Transparent pixels are black; none of that may bleed into the
+		// visible half.
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				c := got.NRGBAAt(x, y)
+				if c.A == 0 {
+					continue
+				}
+				if c.R != solid.R || c.G != solid.G || c.B != solid.B {
+					t.Fatalf("%dx%d: pixel (%d,%d) = %v, want colour of %v", size, size, x, y, c, solid)
+				}
+			}
+		}
+		if size > 1 {
+			if a := got.NRGBAAt(0, 0).A; a != 255 {
+				t.Errorf("%dx%d: left edge alpha = %d, want 255", size, size, a)
+			}
+			if a := got.NRGBAAt(size-1, 0).A; a != 0 {
+				t.Errorf("%dx%d: right edge alpha = %d, want 0", size, size, a)
+			}
+		}
+	}
+}
+
+// TestFitSquare tests that non-square images are centred with their aspect ratio kept
+func TestFitSquare(t *testing.T) {
+	t.Parallel()
+
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+
+	got := newPremultiplied(img).fitSquare(32)
+	if b := got.Bounds(); b.Dx() != 32 || b.Dy() != 32 {
+		t.Fatalf("expected 32x32, got %v", b)
+	}
+	if a := got.NRGBAAt(16, 4).A; a != 0 {
+		t.Errorf("top band alpha = %d, want 0", a)
+	}
+	if a := got.NRGBAAt(16, 16).A; a != 255 {
+		t.Errorf("centre alpha = %d, want 255", a)
+	}
+}
@@ -0,0 +1,111 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+)
+
+// A riffChunk is one chunk of a RIFF file.
+type riffChunk struct {
+	id   string
+	data []byte
+	// offset is the position of the chunk header in the file.
+	offset int64
+}
+
+func (c *riffChunk) errorf(format string, args ...interface{}) *FormatError {
+	fe := formatError(nil, format, args...)
+	fe.Offset = c.offset
+	return fe
+}
+
+// riffChunks checks that file is a RIFF file of the given form type and
+// returns its top-level chunks. A RIFF size running past the end of file is
+// tolerated, as many writers get it wrong.
+func riffChunks(file []byte, form string) ([]riffChunk, error) {
+	if len(file) < 12 {
+		return nil, truncated("RIFF header")
+	}
+	if string(file[:4]) != "RIFF" || string(file[8:12]) != form {
+		fe := formatError(nil, "not a RIFF %s file", form)
+		fe.Offset = 0
+		return nil, fe
+	}
+	end := 8 + int64(binary.LittleEndian.Uint32(file[4:8]))
+	if end > int64(len(file)) {
+		end = int64(len(file))
+	}
+	return parseChunks(file[:end], 12)
+}
+
+// riffSubchunks returns the chunks of a LIST chunk, after its list type.
+func riffSubchunks(list riffChunk) ([]riffChunk, error) {
+	cs, err := parseChunks(list.data, 4)
+	for i := range cs {
+		cs[i].offset += list.offset + 8
+	}
+	if fe, ok := err.(*FormatError); ok {
+		fe.Offset += list.offset + 8
+	}
+	return cs, err
+}
+
+// parseChunks parses the chunks of b from off on. Chunk data is padded to
+// an even length.
+func parseChunks(b []byte, off int64) ([]riffChunk, error) {
+	var cs []riffChunk
+	for off < int64(len(b)) {
+		if int64(len(b))-off < 8 {
+			fe := truncated("RIFF chunk header")
+			fe.Offset = off
+			return nil, fe
+		}
+		size := int64(binary.LittleEndian.Uint32(b[off+4:]))
+		start := off + 8
+		if start+size > int64(len(b)) {
+			fe := truncated("RIFF chunk " + strconv.Quote(string(b[off:off+4])))
+			fe.Offset = off
+			return nil, fe
+		}
+		cs = append(cs, riffChunk{id: string(b[off : off+4]), data: b[start : start+size], offset: off})
+		off = start + size + size%2
+	}
+	return cs, nil
+}
+
+// riffDwords returns b as little-endian 32-bit values.
+func riffDwords(b []byte) []uint32 {
+	v := make([]uint32, len(b)/4)
+	for i := range v {
+		v[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return v
+}
+
+// riffString returns the NUL-terminated string in b.
+func riffString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// writeChunk appends a chunk holding data to b, padded to an even length.
+func writeChunk(b *bytes.Buffer, id string, data []byte) {
+	b.WriteString(id)
+	binary.Write(b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	if len(data)%2 != 0 {
+		b.WriteByte(0)
+	}
+}
+
+// dwordBytes returns v as little-endian 32-bit values.
+func dwordBytes(v []uint32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], x)
+	}
+	return b
+}
@@ -0,0 +1,134 @@
+package ico
+
+// decodeRLE expands BI_RLE8, or BI_RLE4 if rle4 is set, pixel data into
+// one colour index byte per pixel, rows stored bottom-up like the
+// uncompressed bitmap. Pixels the data skips over with end-of-line and
+// delta escapes, or never reaches, keep index 0. Runs past the right edge
+// are clipped.
+func decodeRLE(data []byte, w, h int, rle4 bool) []byte {
+	pix := make([]byte, w*h)
+	x, y := 0, 0
+	set := func(v byte) {
+		if x < w && y < h {
+			pix[y*w+x] = v
+		}
+		x++
+	}
+
+	for i := 0; i+1 < len(data) && y < h; {
+		n, v := int(data[i]), data[i+1]
+		i += 2
+		if n > 0 { // encoded run
+			for j := 0; j < n; j++ {
+				if rle4 {
+					set(v >> (4 * uint(1-j%2)) & 0x0f)
+				} else {
+					set(v)
+				}
+			}
+			continue
+		}
+
+		switch v {
+		case 0: // end of line
+			x, y = 0, y+1
+		case 1: // end of bitmap
+			return pix
+		case 2: // delta
+			if i+1 >= len(data) {
+				return pix
+			}
+			x, y = x+int(data[i]), y+int(data[i+1])
+			i += 2
+		default: // absolute run of v pixels, padded to a 16-bit boundary
+			n, size := int(v), int(v)
+			if rle4 {
+				size = (n + 1) / 2
+			}
+			if i+size > len(data) {
+				return pix
+			}
+			for j := 0; j < n; j++ {
+				if rle4 {
+					set(data[i+j/2] >> (4 * uint(1-j%2)) & 0x0f)
+				} else {
+					set(data[i+j])
+				}
+			}
+			i += size + size%2
+		}
+	}
+	return pix
+}
+
+// encodeRLE compresses h rows of w colour indices, stored bottom-up one byte
+// per pixel, as BI_RLE8 or, if rle4 is set, BI_RLE4 data. Repeated indices
+// become encoded runs and stretches of distinct ones absolute runs.
+func encodeRLE(pix []byte, w, h int, rle4 bool) []byte {
+	var out []byte
+	for y := 0; y < h; y++ {
+		row := pix[y*w : (y+1)*w]
+		for x := 0; x < len(row); {
+			n := runLength(row[x:])
+			if n >= 2 {
+				v := row[x]
+				if rle4 {
+					v = v<<4 | v
+				}
+				out = append(out, byte(n), v)
+				x += n
+				continue
+			}
+
+			// Gather pixels up to the next repeat into an absolute run,
+			// which needs at least 3 pixels.
+			end := x + 1
+			for end < len(row) && end-x < 255 && runLength(row[end:]) < 2 {
+				end++
+			}
+			lit := row[x:end]
+			if len(lit) < 3 {
+				for _, v := range lit {
+					if rle4 {
+						v <<= 4
+					}
+					out = append(out, 1, v)
+				}
+				x = end
+				continue
+			}
+			out = append(out, 0, byte(len(lit)))
+			size := len(lit)
+			if rle4 {
+				size = (len(lit) + 1) / 2
+				for j := 0; j < len(lit); j += 2 {
+					v := lit[j] << 4
+					if j+1 < len(lit) {
+						v |= lit[j+1]
+					}
+					out = append(out, v)
+				}
+			} else {
+				out = append(out, lit...)
+			}
+			if size%2 != 0 {
+				out = append(out, 0)
+			}
+			x = end
+		}
+		if y < h-1 {
+			out = append(out, 0, 0) // end of line
+		}
+	}
+	return append(out, 0, 1) // end of bitmap
+}
+
+// runLength returns how many leading pixels of row share the first one's
+// index, at most 255.
+func runLength(row []byte) int {
+	n := 1
+	for n < len(row) && n < 255 && row[n] == row[0] {
+		n++
+	}
+	return n
+}
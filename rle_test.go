@@ -0,0 +1,146 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// TestDecodeRLE tests expansion of hand-built RLE8 and RLE4 data
+func TestDecodeRLE(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		data []byte
+		w, h int
+		rle4 bool
+		want []byte
+	}{
+		{
+			name: "rle8 runs and absolute",
+			data: []byte{3, 7, 1, 9, 0, 0, 0, 3, 1, 2, 3, 0, 0, 1, 0, 1},
+			w:    4, h: 2,
+			want: []byte{7, 7, 7, 9, 1, 2, 3, 0},
+		},
+		{
+			name: "rle8 delta and clipping",
+			data: []byte{0, 2, 1, 1, 6, 5, 0, 1},
+			w:    3, h: 2,
+			want: []byte{0, 0, 0, 0, 5, 5},
+		},
+		{
+			name: "rle4 runs and odd absolute",
+			data: []byte{5, 0x12, 0, 0, 0, 3, 0x34, 0x50, 0, 1},
+			w:    5, h: 2,
+			rle4: true,
+			want: []byte{1, 2, 1, 2, 1, 3, 4, 5, 0, 0},
+		},
+		{
+			name: "truncated",
+			data: []byte{2, 4, 0, 5, 1},
+			w:    4, h: 1,
+			want: []byte{4, 4, 0, 0},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := decodeRLE(tc.data, tc.w, tc.h, tc.rle4); !bytes.Equal(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestEncodeRLERoundTrip tests that encodeRLE output expands to its input
+func TestEncodeRLERoundTrip(t *testing.T) {
+	t.Parallel()
+
+	rng := rand.New(rand.NewSource(1))
+	for _, rle4 := range []bool{false, true} {
+		for _, w := range []int{1, 2, 3, 7, 300} {
+			max := 256
+			if rle4 {
+				max = 16
+			}
+			h := 5
+			pix := make([]byte, w*h)
+			for i := range pix {
+				// Mix long runs with noise.
+				if rng.Intn(3) == 0 || i == 0 {
+					pix[i] = byte(rng.Intn(max))
+				} else {
+					pix[i] = pix[i-1]
+				}
+			}
+			data := encodeRLE(pix, w, h, rle4)
+			if got := decodeRLE(data, w, h, rle4); !bytes.Equal(got, pix) {
+				t.Errorf("rle4=%v width %d: round trip mismatch", rle4, w)
+			}
+		}
+	}
+}
+
+// TestEncoderRLE tests RLE-compressed BMP entries against uncompressed ones
+func TestEncoderRLE(t *testing.T) {
+	t.Parallel()
+
+	for _, bits := range []int{4, 8} {
+		img := createPalettedImage(32, 1<<uint(bits)-1)
+
+		var plain, packed bytes.Buffer
+		if err := (&Encoder{Format: FormatBMP, Bits: bits}).Encode(&plain, img); err != nil {
+			t.Fatalf("%d-bit: failed to encode: %v", bits, err)
+		}
+		if err := (&Encoder{Format: FormatBMP, Bits: bits, RLE: true}).Encode(&packed, img); err != nil {
+			t.Fatalf("%d-bit: failed to encode: %v", bits, err)
+		}
+
+		dib := packed.Bytes()[headSize+direntrySize:]
+		want := uint32(biRLE8)
+		if bits == 4 {
+			want = biRLE4
+		}
+		if got := binary.LittleEndian.Uint32(dib[16:20]); got != want {
+			t.Errorf("%d-bit: expected compression %d, got %d", bits, want, got)
+		}
+
+		infos, err := ReadDirectory(bytes.NewReader(packed.Bytes()))
+		if err != nil {
+			t.Fatalf("%d-bit: failed to read directory: %v", bits, err)
+		}
+		if infos[0].ImageBits != bits || infos[0].ImageWidth != 32 || infos[0].ImageHeight != 32 {
+			t.Errorf("%d-bit: unexpected info %+v", bits, infos[0])
+		}
+
+		plainImg, err := Decode(bytes.NewReader(plain.Bytes()))
+		if err != nil {
+			t.Fatalf("%d-bit: failed to decode: %v", bits, err)
+		}
+		got, err := Decode(bytes.NewReader(packed.Bytes()))
+		if err != nil {
+			t.Fatalf("%d-bit: failed to decode RLE entry: %v", bits, err)
+		}
+		diff, err := fastCompare(toNRGBAForWrite(plainImg), toNRGBAForWrite(got))
+		if err != nil {
+			t.Fatalf("%d-bit: comparison error: %v", bits, err)
+		}
+		if diff != 0 {
+			t.Errorf("%d-bit: RLE entry differs by %d", bits, diff)
+		}
+	}
+
+	// 1 and 32-bit entries are never compressed.
+	var buf bytes.Buffer
+	if err := (&Encoder{Format: FormatBMP, Bits: 1, RLE: true}).Encode(&buf, createMaskedImage(16)); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	if got := binary.LittleEndian.Uint32(buf.Bytes()[headSize+direntrySize+16:]); got != biRGB {
+		t.Errorf("1-bit: expected no compression, got %d", got)
+	}
+}
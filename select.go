@@ -0,0 +1,112 @@
+package ico
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// A Selection is a strategy for choosing one entry of a multi-size icon.
+type Selection int
+
+const (
+	// SelectNearestLarger picks an exact size match, else the smallest
+	// entry larger than requested, else the largest entry. This mirrors
+	// Windows, which prefers scaling down to scaling up.
+	SelectNearestLarger Selection = iota
+	// SelectExact picks an entry of exactly the requested size and fails
+	// if there is none.
+	SelectExact
+	// SelectLargest picks the entry with the most pixels, ignoring the
+	// requested size.
+	SelectLargest
+	// SelectHighestDepth picks among the entries with the highest bit
+	// depth, using SelectNearestLarger between them.
+	SelectHighestDepth
+)
+
+// DecodeBest decodes the entry of r that best fits width x height, as
+// chosen by SelectNearestLarger. Only the chosen payload is decoded.
+func DecodeBest(r io.Reader, width, height int) (image.Image, error) {
+	return DecodeBestBy(r, width, height, SelectNearestLarger)
+}
+
+// DecodeBestBy is like DecodeBest but chooses the entry with sel.
+func DecodeBestBy(r io.Reader, width, height int, sel Selection) (image.Image, error) {
+	var dec Decoder
+	return dec.DecodeBestBy(r, width, height, sel)
+}
+
+// DecodeBest is like the package-level DecodeBest but applies dec's limits.
+func (dec *Decoder) DecodeBest(r io.Reader, width, height int) (image.Image, error) {
+	return dec.DecodeBestBy(r, width, height, SelectNearestLarger)
+}
+
+// DecodeBestBy is like the package-level DecodeBestBy but applies dec's
+// limits. Only the chosen entry counts towards the pixel limits.
+func (dec *Decoder) DecodeBestBy(r io.Reader, width, height int, sel Selection) (image.Image, error) {
+	d := decoder{limits: *dec}
+	file, err := d.decodeDirectory(r)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := d.entryInfos(file)
+	if err != nil {
+		return nil, err
+	}
+
+	i := SelectEntry(infos, width, height, sel)
+	if i < 0 {
+		return nil, fmt.Errorf("%w for %dx%d", ErrNoMatch, width, height)
+	}
+	if err := d.checkPixels(infos[i : i+1]); err != nil {
+		return nil, err
+	}
+	return d.decodeEntry(file, i)
+}
+
+// SelectEntry returns the index of the entry of infos chosen by sel for a
+// width x height request, or -1 if none qualifies. Sizes and bit depths
+// are taken from the payload headers. Ties go to the higher bit depth,
+// then to the earlier entry.
+func SelectEntry(infos []EntryInfo, width, height int, sel Selection) int {
+	best := -1
+	for i := range infos {
+		c := &infos[i]
+		if sel == SelectExact && (c.ImageWidth != width || c.ImageHeight != height) {
+			continue
+		}
+		if best < 0 || better(c, &infos[best], width, height, sel) {
+			best = i
+		}
+	}
+	return best
+}
+
+// better reports whether a is a strictly better choice than b under sel.
+func better(a, b *EntryInfo, width, height int, sel Selection) bool {
+	if sel == SelectHighestDepth && a.ImageBits != b.ImageBits {
+		return a.ImageBits > b.ImageBits
+	}
+
+	areaA := a.ImageWidth * a.ImageHeight
+	areaB := b.ImageWidth * b.ImageHeight
+	switch sel {
+	case SelectNearestLarger, SelectHighestDepth:
+		fitsA := a.ImageWidth >= width && a.ImageHeight >= height
+		fitsB := b.ImageWidth >= width && b.ImageHeight >= height
+		if fitsA != fitsB {
+			return fitsA
+		}
+		if areaA != areaB {
+			// Among entries that fit, the smallest is nearest; among
+			// entries that do not, the largest is.
+			return (areaA < areaB) == fitsA
+		}
+	case SelectLargest:
+		if areaA != areaB {
+			return areaA > areaB
+		}
+	}
+	return a.ImageBits > b.ImageBits
+}
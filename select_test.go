@@ -0,0 +1,98 @@
+package ico
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// TestSelectEntry tests each selection strategy against a synthetic directory
+func TestSelectEntry(t *testing.T) {
+	t.Parallel()
+
+	infos := []EntryInfo{
+		{ImageWidth: 16, ImageHeight: 16, ImageBits: 32},
+		{ImageWidth: 32, ImageHeight: 32, ImageBits: 8},
+		{ImageWidth: 32, ImageHeight: 32, ImageBits: 32},
+		{ImageWidth: 48, ImageHeight: 48, ImageBits: 4},
+		{ImageWidth: 256, ImageHeight: 256, ImageBits: 24},
+	}
+
+	tests := []struct {
+		name          string
+		width, height int
+		sel           Selection
+		want          int
+	}{
+		{"nearest exact", 16, 16, SelectNearestLarger, 0},
+		{"nearest exact prefers depth", 32, 32, SelectNearestLarger, 2},
+		{"nearest larger", 20, 20, SelectNearestLarger, 2},
+		{"nearest larger non-square", 40, 10, SelectNearestLarger, 3},
+		{"nearest falls back to largest", 512, 512, SelectNearestLarger, 4},
+		{"exact", 48, 48, SelectExact, 3},
+		{"exact prefers depth", 32, 32, SelectExact, 2},
+		{"exact missing", 24, 24, SelectExact, -1},
+		{"largest", 16, 16, SelectLargest, 4},
+		{"highest depth", 16, 16, SelectHighestDepth, 0},
+		{"highest depth nearest larger", 20, 20, SelectHighestDepth, 2},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := SelectEntry(infos, tc.width, tc.height, tc.sel); got != tc.want {
+				t.Errorf("expected entry %d, got %d", tc.want, got)
+			}
+		})
+	}
+
+	if got := SelectEntry(nil, 16, 16, SelectNearestLarger); got != -1 {
+		t.Errorf("empty directory: expected -1, got %d", got)
+	}
+}
+
+// TestDecodeBest tests decoding a single chosen entry of a multi-size file
+func TestDecodeBest(t *testing.T) {
+	t.Parallel()
+
+	data, err := os.ReadFile("testdata/multi_sizes.ico")
+	if err != nil {
+		t.Fatalf("failed to read multi_sizes.ico: %v", err)
+	}
+
+	tests := []struct {
+		width, height int
+		sel           Selection
+		want          int
+	}{
+		{16, 16, SelectNearestLarger, 16},
+		{20, 20, SelectNearestLarger, 32},
+		{1024, 1024, SelectNearestLarger, 256},
+		{48, 48, SelectExact, 48},
+		{16, 16, SelectLargest, 256},
+	}
+
+	for _, tc := range tests {
+		img, err := DecodeBestBy(bytes.NewReader(data), tc.width, tc.height, tc.sel)
+		if err != nil {
+			t.Fatalf("%dx%d: failed to decode: %v", tc.width, tc.height, err)
+		}
+		if b := img.Bounds(); b.Dx() != tc.want || b.Dy() != tc.want {
+			t.Errorf("%dx%d: expected %dx%d, got %dx%d", tc.width, tc.height, tc.want, tc.want, b.Dx(), b.Dy())
+		}
+	}
+
+	img, err := DecodeBest(bytes.NewReader(data), 24, 24)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 32 {
+		t.Errorf("expected 32x32, got %dx%d", b.Dx(), b.Dy())
+	}
+
+	if _, err := DecodeBestBy(bytes.NewReader(data), 24, 24, SelectExact); err == nil {
+		t.Error("expected error for missing exact size, got nil")
+	}
+}
@@ -5,66 +5,333 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"image"
+	"image/color"
 	"image/png"
 	"io"
+	"math"
 )
 
-// ErrImageTooLarge is returned when the image dimensions exceed 256x256 pixels.
+// ErrImageTooLarge is returned when the image dimensions exceed 256x256
+// pixels, except for PNG entries written with Encoder.LargePNG.
 var ErrImageTooLarge = errors.New("ico: image dimensions must not exceed 256x256 pixels")
 
+// DefaultSizes is the size ladder used by EncodeSizes when none is given,
+// covering the sizes Windows looks up for shell, taskbar and title bars.
+var DefaultSizes = []int{16, 24, 32, 48, 64, 256}
+
+const (
+	headSize     = 6  // binary size of head
+	direntrySize = 16 // binary size of direntry
+
+	typeIcon   = 1 // head.Type of .ico files
+	typeCursor = 2 // head.Type of .cur files
+)
+
+// Format selects how an entry's image is stored inside an icon.
+type Format uint8
+
+const (
+	// FormatAuto follows Microsoft's recommendation: PNG for 256x256
+	// entries and BMP for anything smaller.
+	FormatAuto Format = iota
+	// FormatPNG stores the entry as a PNG stream.
+	FormatPNG
+	// FormatBMP stores the entry as a classic DIB: a BITMAPINFOHEADER with
+	// doubled height, the XOR bitmap and a 1-bit AND mask.
+	FormatBMP
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatAuto:
+		return "auto"
+	case FormatPNG:
+		return "png"
+	case FormatBMP:
+		return "bmp"
+	}
+	return fmt.Sprintf("Format(%d)", uint8(f))
+}
+
+// An Encoder writes ICO files using configurable entry encoding.
+type Encoder struct {
+	// Format is the payload format used for entries that do not set their
+	// own. The zero value is FormatAuto.
+	Format Format
+	// Bits is the colour depth used for entries that do not set their own:
+	// 1, 4 or 8 for paletted entries quantised from the source image, or 32
+	// for true colour with alpha. The zero value means 32.
+	Bits int
+	// RLE compresses 4 and 8-bit BMP entries as BI_RLE4 and BI_RLE8. Few
+	// programs besides Windows itself read compressed icon bitmaps.
+	RLE bool
+	// LargePNG allows PNG entries larger than 256x256, which Windows 10 and
+	// later and most browsers accept. Their directory width and height are
+	// stored as 0, so readers must take the size from the PNG header.
+	LargePNG bool
+}
+
+// An EntryImage is one image written by Encoder.EncodeEntries, together
+// with per-entry settings that override the Encoder's.
+type EntryImage struct {
+	Image image.Image
+	// Format overrides Encoder.Format for this entry unless it is FormatAuto.
+	Format Format
+	// Bits overrides Encoder.Bits for this entry unless it is zero.
+	Bits int
+}
+
 func Encode(w io.Writer, im image.Image) error {
-	b := im.Bounds()
+	return EncodeAll(w, []image.Image{im})
+}
 
-	if b.Dx() > 256 || b.Dy() > 256 {
-		return ErrImageTooLarge
+// EncodeAll writes imgs to w as a single ICO file holding one PNG entry per
+// image, in the order given. Each image must be 256x256 or smaller.
+func EncodeAll(w io.Writer, imgs []image.Image) error {
+	enc := Encoder{Format: FormatPNG}
+	return enc.EncodeAll(w, imgs)
+}
+
+// EncodeSizes scales master down (or up) to each of the given square sizes
+// and writes the results to w as one multi-size ICO file using the
+// Encoder's default settings. A nil sizes uses DefaultSizes. Non-square
+// masters are fitted inside each square on a transparent background.
+func EncodeSizes(w io.Writer, master image.Image, sizes []int) error {
+	var enc Encoder
+	return enc.EncodeSizes(w, master, sizes)
+}
+
+// Encode writes im to w as a single-entry ICO file.
+func (enc *Encoder) Encode(w io.Writer, im image.Image) error {
+	return enc.EncodeAll(w, []image.Image{im})
+}
+
+// EncodeAll writes imgs to w as a single ICO file holding one entry per
+// image, in the order given. Each image must be 256x256 or smaller unless
+// enc.LargePNG is set and the entry is stored as PNG.
+func (enc *Encoder) EncodeAll(w io.Writer, imgs []image.Image) error {
+	entries := make([]EntryImage, len(imgs))
+	for i, im := range imgs {
+		entries[i].Image = im
+	}
+	return enc.EncodeEntries(w, entries)
+}
+
+// EncodeSizes is like the package-level EncodeSizes but uses enc's settings.
+func (enc *Encoder) EncodeSizes(w io.Writer, master image.Image, sizes []int) error {
+	if sizes == nil {
+		sizes = DefaultSizes
+	}
+	for _, size := range sizes {
+		if size <= 0 {
+			return fmt.Errorf("ico: invalid size %d", size)
+		}
+		if size > 256 && !enc.LargePNG {
+			return ErrImageTooLarge
+		}
+	}
+	if b := master.Bounds(); b.Empty() {
+		return fmt.Errorf("ico: invalid image size %dx%d", b.Dx(), b.Dy())
+	}
+
+	src := newPremultiplied(master)
+	imgs := make([]image.Image, len(sizes))
+	for i, size := range sizes {
+		imgs[i] = src.fitSquare(size)
+	}
+	return enc.EncodeAll(w, imgs)
+}
+
+// EncodeEntries is like EncodeAll but applies the per-entry settings of
+// each EntryImage.
+func (enc *Encoder) EncodeEntries(w io.Writer, imgs []EntryImage) error {
+	return enc.encode(w, typeIcon, imgs, nil)
+}
+
+// encode writes imgs as a file of the given head type. For cursors, the
+// directory's Plane and Bits fields hold hotspots[i] instead.
+func (enc *Encoder) encode(w io.Writer, typ uint16, imgs []EntryImage, hotspots []image.Point) error {
+	entries := make([]direntry, len(imgs))
+	payloads := make([][]byte, len(imgs))
+	for i, e := range imgs {
+		entry, data, err := enc.encodeEntry(e)
+		if err != nil {
+			return err
+		}
+		if typ == typeCursor {
+			entry.Plane = uint16(hotspots[i].X)
+			entry.Bits = uint16(hotspots[i].Y)
+		}
+		entries[i] = entry
+		payloads[i] = data
+	}
+	return writeFile(w, typ, entries, payloads)
+}
+
+// writeFile writes a file of the given head type, laying payloads[i] out
+// after the directory in order and filling in the Offset of entries[i].
+func writeFile(w io.Writer, typ uint16, entries []direntry, payloads [][]byte) error {
+	if len(entries) == 0 {
+		return ErrNoImages
+	}
+	if len(entries) > math.MaxUint16 {
+		return errors.New("ico: too many images")
 	}
 
 	header := head{
 		0,
-		1,
-		1,
+		typ,
+		uint16(len(entries)),
 	}
-	entry := direntry{
-		Plane:  1,
-		Bits:   32,
-		Offset: 22,
+
+	offset := uint32(headSize + direntrySize*len(entries))
+	for i, data := range payloads {
+		if uint64(offset)+uint64(len(data)) > math.MaxUint32 {
+			return errors.New("ico: encoded file too large")
+		}
+		entries[i].Offset = offset
+		offset += uint32(len(data))
 	}
 
-	pngbuffer := new(bytes.Buffer)
-	pngwriter := bufio.NewWriter(pngbuffer)
-	err := png.Encode(pngwriter, im)
-	if err != nil {
+	bb := new(bytes.Buffer)
+	if err := binary.Write(bb, binary.LittleEndian, header); err != nil {
 		return err
 	}
-	err = pngwriter.Flush()
-	if err != nil {
+	if err := binary.Write(bb, binary.LittleEndian, entries); err != nil {
 		return err
 	}
-	entry.Size = uint32(len(pngbuffer.Bytes()))
+	if _, err := w.Write(bb.Bytes()); err != nil {
+		return err
+	}
+	for _, data := range payloads {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	entry.Width = uint8(b.Dx())
-	entry.Height = uint8(b.Dy())
-	bb := new(bytes.Buffer)
+// format resolves the payload format of e: its own setting, then the
+// encoder's, then the FormatAuto size rule.
+func (enc *Encoder) format(e EntryImage) Format {
+	f := e.Format
+	if f == FormatAuto {
+		f = enc.Format
+	}
+	if f == FormatAuto {
+		b := e.Image.Bounds()
+		if b.Dx() >= 256 || b.Dy() >= 256 {
+			return FormatPNG
+		}
+		return FormatBMP
+	}
+	return f
+}
 
-	var e error
-	e = binary.Write(bb, binary.LittleEndian, header)
-	if e != nil {
-		return e
+// bits resolves the colour depth of e the same way format does.
+func (enc *Encoder) bits(e EntryImage) int {
+	if e.Bits != 0 {
+		return e.Bits
 	}
-	e = binary.Write(bb, binary.LittleEndian, entry)
-	if e != nil {
-		return e
+	if enc.Bits != 0 {
+		return enc.Bits
 	}
+	return 32
+}
 
-	_, e = w.Write(bb.Bytes())
-	if e != nil {
-		return e
+// encodeEntry encodes the payload of e and returns it with its directory
+// entry, all fields but Offset filled in.
+func (enc *Encoder) encodeEntry(e EntryImage) (direntry, []byte, error) {
+	b := e.Image.Bounds()
+	entry := direntry{
+		Width:  dirSize(b.Dx()),
+		Height: dirSize(b.Dy()),
+		Plane:  1,
 	}
-	_, e = w.Write(pngbuffer.Bytes())
-	if e != nil {
-		return e
+	if b.Dx() > 256 || b.Dy() > 256 {
+		if !enc.LargePNG || enc.format(e) != FormatPNG {
+			return entry, nil, ErrImageTooLarge
+		}
 	}
 
-	return e
+	bits := enc.bits(e)
+	switch bits {
+	case 1, 4:
+		entry.Palette = uint8(1 << uint(bits))
+	case 8, 32:
+	default:
+		return entry, nil, fmt.Errorf("ico: unsupported bit depth %d", bits)
+	}
+	entry.Bits = uint16(bits)
+
+	var (
+		data []byte
+		err  error
+	)
+	switch f := enc.format(e); f {
+	case FormatPNG:
+		if bits == 32 {
+			data, err = encodePNG(e.Image)
+		} else {
+			data, err = encodePNG(palettedImage(e.Image, bits))
+		}
+	case FormatBMP:
+		data, err = encodeDIB(e.Image, bits, enc.RLE && (bits == 4 || bits == 8))
+	default:
+		err = fmt.Errorf("ico: unknown format %s", f)
+	}
+	if err != nil {
+		return entry, nil, err
+	}
+	entry.Size = uint32(len(data))
+	return entry, data, nil
+}
+
+// dirSize returns the directory byte for an entry dimension: the size
+// itself, or 0 for 256 and above.
+func dirSize(n int) uint8 {
+	if n >= 256 {
+		return 0
+	}
+	return uint8(n)
+}
+
+// palettedImage quantises im to at most 1<<bits colours, one of which is
+// fully transparent when im has transparent pixels.
+func palettedImage(im image.Image, bits int) *image.Paletted {
+	transparent := color.NRGBA{}
+	pal := indexedPalette(im, bits, transparent)
+	opaque := pal
+	if n := len(pal); n > 0 && pal[n-1] == transparent {
+		opaque = pal[:n-1]
+	}
+	idx := newPaletteIndexer(opaque)
+
+	b := im.Bounds()
+	dst := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), pal)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c := color.NRGBAModel.Convert(im.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			if c.A < alphaThreshold {
+				dst.SetColorIndex(x, y, uint8(len(pal)-1))
+				continue
+			}
+			dst.SetColorIndex(x, y, idx.index(c))
+		}
+	}
+	return dst
+}
+
+func encodePNG(im image.Image) ([]byte, error) {
+	pngbuffer := new(bytes.Buffer)
+	pngwriter := bufio.NewWriter(pngbuffer)
+	if err := png.Encode(pngwriter, im); err != nil {
+		return nil, err
+	}
+	if err := pngwriter.Flush(); err != nil {
+		return nil, err
+	}
+	return pngbuffer.Bytes(), nil
 }
@@ -1,9 +1,12 @@
 package ico
 
 import (
+	"bytes"
+	"encoding/binary"
 	"image"
 	"image/color"
 	"image/png"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
@@ -293,6 +296,312 @@ func TestEncodeFromPNG(t *testing.T) {
 	}
 }
 
+// TestEncodeAll tests encoding several sizes into one ICO and decoding them back
+func TestEncodeAll(t *testing.T) {
+	t.Parallel()
+
+	sizes := []int{16, 24, 32, 48, 64, 256}
+	imgs := make([]image.Image, len(sizes))
+	for i, size := range sizes {
+		imgs[i] = createTestImageForWrite(size)
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, imgs); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+
+	decoded, err := DecodeAll(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if len(decoded) != len(imgs) {
+		t.Fatalf("expected %d images, got %d", len(imgs), len(decoded))
+	}
+
+	for i := range imgs {
+		diff, err := fastCompare(toNRGBAForWrite(imgs[i]), toNRGBAForWrite(decoded[i]))
+		if err != nil {
+			t.Fatalf("image %d comparison error: %v", i, err)
+		}
+		if diff != 0 {
+			t.Errorf("image %d: pixels differ by %d", i, diff)
+		}
+	}
+}
+
+// TestEncodeAllErrors tests EncodeAll argument validation
+func TestEncodeAllErrors(t *testing.T) {
+	t.Parallel()
+
+	if err := EncodeAll(io.Discard, nil); err == nil {
+		t.Error("expected error for empty image list, got nil")
+	}
+
+	imgs := []image.Image{
+		image.NewNRGBA(image.Rect(0, 0, 16, 16)),
+		image.NewNRGBA(image.Rect(0, 0, 512, 512)),
+	}
+	if err := EncodeAll(io.Discard, imgs); err != ErrImageTooLarge {
+		t.Errorf("expected ErrImageTooLarge, got %v", err)
+	}
+}
+
+// TestEncoderBMP tests writing DIB entries and decoding them back
+func TestEncoderBMP(t *testing.T) {
+	t.Parallel()
+
+	sizes := []int{16, 24, 32, 48, 256}
+	imgs := make([]image.Image, len(sizes))
+	for i, size := range sizes {
+		imgs[i] = createMaskedImage(size)
+	}
+
+	var buf bytes.Buffer
+	enc := Encoder{Format: FormatBMP}
+	if err := enc.EncodeAll(&buf, imgs); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+
+	data := buf.Bytes()
+	if bytes.Contains(data, pngHeader) {
+		t.Error("expected DIB entries, found PNG payload")
+	}
+
+	decoded, err := DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if len(decoded) != len(imgs) {
+		t.Fatalf("expected %d images, got %d", len(imgs), len(decoded))
+	}
+
+	for i := range imgs {
+		diff, err := fastCompare(toNRGBAForWrite(imgs[i]), toNRGBAForWrite(decoded[i]))
+		if err != nil {
+			t.Fatalf("image %d comparison error: %v", i, err)
+		}
+		if diff != 0 {
+			t.Errorf("image %d: pixels differ by %d", i, diff)
+		}
+	}
+}
+
+// TestEncoderFormatPolicy tests the default format policy and per-entry overrides
+func TestEncoderFormatPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		encoder Encoder
+		entries []EntryImage
+		wantPNG []bool
+	}{
+		{
+			name:    "auto",
+			encoder: Encoder{},
+			entries: []EntryImage{
+				{Image: createMaskedImage(16)},
+				{Image: createMaskedImage(48)},
+				{Image: createMaskedImage(256)},
+			},
+			wantPNG: []bool{false, false, true},
+		},
+		{
+			name:    "global PNG",
+			encoder: Encoder{Format: FormatPNG},
+			entries: []EntryImage{
+				{Image: createMaskedImage(16)},
+				{Image: createMaskedImage(256)},
+			},
+			wantPNG: []bool{true, true},
+		},
+		{
+			name:    "per-entry override",
+			encoder: Encoder{},
+			entries: []EntryImage{
+				{Image: createMaskedImage(16), Format: FormatPNG},
+				{Image: createMaskedImage(32)},
+				{Image: createMaskedImage(256), Format: FormatBMP},
+			},
+			wantPNG: []bool{true, false, false},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			if err := tc.encoder.EncodeEntries(&buf, tc.entries); err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+
+			data := buf.Bytes()
+			for i, want := range tc.wantPNG {
+				e := readTestEntry(t, data, i)
+				got := bytes.HasPrefix(data[e.Offset:], pngHeader)
+				if got != want {
+					t.Errorf("entry %d: PNG=%v, want %v", i, got, want)
+				}
+			}
+
+			decoded, err := DecodeAll(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			for i := range tc.entries {
+				diff, err := fastCompare(toNRGBAForWrite(tc.entries[i].Image), toNRGBAForWrite(decoded[i]))
+				if err != nil {
+					t.Fatalf("image %d comparison error: %v", i, err)
+				}
+				if diff != 0 {
+					t.Errorf("image %d: pixels differ by %d", i, diff)
+				}
+			}
+		})
+	}
+}
+
+// TestEncoderIndexed tests writing 1, 4 and 8-bit entries
+func TestEncoderIndexed(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		format      Format
+		bits        int
+		img         *image.NRGBA
+		wantPalette byte
+	}{
+		// One palette slot is taken by the transparent border.
+		{"BMP 1-bit", FormatBMP, 1, createPalettedImage(32, 1), 2},
+		{"BMP 4-bit", FormatBMP, 4, createPalettedImage(32, 15), 16},
+		{"BMP 8-bit", FormatBMP, 8, createPalettedImage(32, 255), 0},
+		{"PNG 4-bit", FormatPNG, 4, createPalettedImage(32, 15), 16},
+		{"PNG 8-bit", FormatPNG, 8, createPalettedImage(32, 255), 0},
+		// The AND mask shows black under masked pixels, so no slot is
+		// taken when black is already used.
+		{"BMP 1-bit with black", FormatBMP, 1, createBlackPalettedImage(16, 2), 2},
+		{"BMP 4-bit with black", FormatBMP, 4, createBlackPalettedImage(32, 16), 16},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			img := tc.img
+
+			var buf bytes.Buffer
+			enc := Encoder{Format: tc.format, Bits: tc.bits}
+			if err := enc.Encode(&buf, img); err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+
+			e := readTestEntry(t, buf.Bytes(), 0)
+			if int(e.Bits) != tc.bits || e.Plane != 1 || e.Palette != tc.wantPalette {
+				t.Errorf("directory: bits=%d plane=%d palette=%d, want %d 1 %d",
+					e.Bits, e.Plane, e.Palette, tc.bits, tc.wantPalette)
+			}
+
+			decoded, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			diff, err := fastCompare(img, toNRGBAForWrite(decoded))
+			if err != nil {
+				t.Fatalf("comparison error: %v", err)
+			}
+			if diff != 0 {
+				t.Errorf("pixels differ by %d", diff)
+			}
+		})
+	}
+}
+
+// TestEncoderQuantize tests that true-colour input is reduced to the palette size
+func TestEncoderQuantize(t *testing.T) {
+	t.Parallel()
+
+	img := createTestImageForWrite(64)
+	for _, bits := range []int{1, 4, 8} {
+		var buf bytes.Buffer
+		enc := Encoder{Format: FormatBMP, Bits: bits}
+		if err := enc.Encode(&buf, img); err != nil {
+			t.Fatalf("%d-bit: failed to encode: %v", bits, err)
+		}
+		decoded, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%d-bit: failed to decode: %v", bits, err)
+		}
+
+		colors := make(map[color.Color]bool)
+		b := decoded.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				colors[decoded.At(x, y)] = true
+			}
+		}
+		if len(colors) > 1<<uint(bits) {
+			t.Errorf("%d-bit: decoded image uses %d colours", bits, len(colors))
+		}
+	}
+
+	if err := (&Encoder{Bits: 16}).Encode(io.Discard, img); err == nil {
+		t.Error("expected error for unsupported bit depth, got nil")
+	}
+	err := (&Encoder{Format: Format(3)}).Encode(io.Discard, img)
+	if err == nil || err.Error() != "ico: unknown format Format(3)" {
+		t.Errorf("expected unknown format error, got %v", err)
+	}
+}
+
+// TestEncodeSizeLadder tests generating a size ladder from one master image
+func TestEncodeSizeLadder(t *testing.T) {
+	t.Parallel()
+
+	master := createTestImageForWrite(1024)
+
+	var buf bytes.Buffer
+	if err := EncodeSizes(&buf, master, nil); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	decoded, err := DecodeAll(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if len(decoded) != len(DefaultSizes) {
+		t.Fatalf("expected %d images, got %d", len(DefaultSizes), len(decoded))
+	}
+	for i, size := range DefaultSizes {
+		if b := decoded[i].Bounds(); b.Dx() != size || b.Dy() != size {
+			t.Errorf("image %d: expected %dx%d, got %dx%d", i, size, size, b.Dx(), b.Dy())
+		}
+	}
+
+	buf.Reset()
+	enc := Encoder{Format: FormatPNG}
+	if err := enc.EncodeSizes(&buf, image.NewNRGBA(image.Rect(0, 0, 300, 100)), []int{32}); err != nil {
+		t.Fatalf("failed to encode non-square master: %v", err)
+	}
+	img, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 32 {
+		t.Errorf("expected 32x32, got %dx%d", b.Dx(), b.Dy())
+	}
+
+	if err := EncodeSizes(io.Discard, master, []int{16, 512}); err != ErrImageTooLarge {
+		t.Errorf("expected ErrImageTooLarge, got %v", err)
+	}
+	if err := EncodeSizes(io.Discard, master, []int{0}); err == nil {
+		t.Error("expected error for zero size, got nil")
+	}
+}
+
 // Helper functions
 
 func createTestImageForWrite(size int) *image.NRGBA {
@@ -353,3 +662,125 @@ func toNRGBAForWrite(img image.Image) *image.NRGBA {
 	}
 	return nrgba
 }
+
+// createMaskedImage returns an opaque gradient with a fully transparent
+// border, so that it survives the AND mask of a DIB entry unchanged.
+func createMaskedImage(size int) *image.NRGBA {
+	img := createTestImageForWrite(size)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if x < 2 || y < 2 || x >= size-2 || y >= size-2 {
+				img.SetNRGBA(x, y, color.NRGBA{})
+			}
+		}
+	}
+	return img
+}
+
+// readTestEntry returns the i-th directory entry of an encoded ICO file.
+func readTestEntry(t *testing.T, data []byte, i int) direntry {
+	t.Helper()
+	var e direntry
+	r := bytes.NewReader(data[headSize+i*direntrySize:])
+	if err := binary.Read(r, binary.LittleEndian, &e); err != nil {
+		t.Fatalf("failed to read entry %d: %v", i, err)
+	}
+	return e
+}
+
+// createPalettedImage returns an image using exactly n opaque colours with a
+// fully transparent border.
+func createPalettedImage(size, n int) *image.NRGBA {
+	img := createMaskedImage(size)
+	for y := 2; y < size-2; y++ {
+		for x := 2; x < size-2; x++ {
+			i := (y*size + x) % n
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(i * 7), G: uint8(255 - i), B: uint8(i * 3), A: 255})
+		}
+	}
+	return img
+}
+
+// createBlackPalettedImage is like createPalettedImage but its first and
+// last colours are black and white, as in monochrome icons.
+func createBlackPalettedImage(size, n int) *image.NRGBA {
+	img := createPalettedImage(size, n)
+	for y := 2; y < size-2; y++ {
+		for x := 2; x < size-2; x++ {
+			switch (y*size + x) % n {
+			case 0:
+				img.SetNRGBA(x, y, color.NRGBA{A: 255})
+			case n - 1:
+				img.SetNRGBA(x, y, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+			}
+		}
+	}
+	return img
+}
+
+// TestEncoderLargePNG tests opt-in PNG entries larger than 256x256
+func TestEncoderLargePNG(t *testing.T) {
+	t.Parallel()
+
+	img := createTestImageForWrite(512)
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, img); err != ErrImageTooLarge {
+		t.Errorf("expected ErrImageTooLarge without LargePNG, got %v", err)
+	}
+	enc := Encoder{Format: FormatBMP, LargePNG: true}
+	if err := enc.Encode(&buf, img); err != ErrImageTooLarge {
+		t.Errorf("expected ErrImageTooLarge for BMP entry, got %v", err)
+	}
+
+	buf.Reset()
+	enc = Encoder{LargePNG: true}
+	if err := enc.EncodeSizes(&buf, img, []int{16, 300, 512}); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	data := buf.Bytes()
+	for i, size := range []int{16, 300, 512} {
+		e := readTestEntry(t, data, i)
+		want := uint8(size)
+		if size >= 256 {
+			want = 0
+		}
+		if e.Width != want || e.Height != want {
+			t.Errorf("entry %d: expected directory size %d, got %dx%d", i, want, e.Width, e.Height)
+		}
+	}
+
+	infos, err := ReadDirectory(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	for i, size := range []int{16, 300, 512} {
+		if infos[i].Width != size || infos[i].ImageWidth != size || infos[i].ImageHeight != size {
+			t.Errorf("entry %d: expected %d, got %+v", i, size, infos[i])
+		}
+	}
+
+	decoded, err := DecodeBestBy(bytes.NewReader(data), 0, 0, SelectLargest)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if b := decoded.Bounds(); b.Dx() != 512 || b.Dy() != 512 {
+		t.Errorf("expected 512x512, got %v", b)
+	}
+
+	ic, err := ParseIcon(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if ic.Entries[2].Width != 512 {
+		t.Errorf("expected parsed width 512, got %d", ic.Entries[2].Width)
+	}
+	ic.Remove(0)
+	buf.Reset()
+	if err := ic.Encode(&buf); err != nil {
+		t.Fatalf("failed to encode edited icon: %v", err)
+	}
+	if e := readTestEntry(t, buf.Bytes(), 1); e.Width != 0 {
+		t.Errorf("expected directory width 0 after edit, got %d", e.Width)
+	}
+}